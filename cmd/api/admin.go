@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mnabil1718/greenlight/internal/data"
+	"github.com/mnabil1718/greenlight/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+type ListUserRequest struct {
+	Name      string
+	Email     string
+	Activated *bool
+	data.Filters
+}
+
+type AdminUpdateUserRequest struct {
+	Activated *bool `json:"activated"`
+}
+
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var listUserRequest ListUserRequest
+	v := validator.New()
+	queryString := r.URL.Query()
+
+	listUserRequest.Name = app.readString(queryString, "name", "")
+	listUserRequest.Email = app.readString(queryString, "email", "")
+	listUserRequest.Activated = app.readBool(queryString, "activated", v)
+	listUserRequest.PageSize = app.readInt(queryString, "page_size", 20, v)
+	listUserRequest.Page = app.readInt(queryString, "page", 1, v)
+	listUserRequest.Sort = app.readString(queryString, "sort", "id")
+	listUserRequest.SortSafelist = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
+	if data.ValidateFilters(v, &listUserRequest.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(listUserRequest.Name, listUserRequest.Email, listUserRequest.Activated, listUserRequest.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"metadata": metadata, "users": users}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.getIdFromRequestContext(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.getIdFromRequestContext(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var adminUpdateUserRequest AdminUpdateUserRequest
+	err = app.readJSON(w, r, &adminUpdateUserRequest)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if adminUpdateUserRequest.Activated != nil {
+		user.Activated = *adminUpdateUserRequest.Activated
+
+		// recorded so activating through single sign-on
+		// can tell these apart from unfinished sign-ups
+		switch {
+		case user.Activated:
+			user.DeactivatedAt = nil
+		case user.DeactivatedAt == nil:
+			now := time.Now()
+			user.DeactivatedAt = &now
+		}
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// a deactivated account shouldn't keep its open sessions,
+	// nor an activation token that would let it back in
+	if !user.Activated {
+		err = app.revokeSessions(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.models.Tokens.DeleteForAllUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) forceUserPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.getIdFromRequestContext(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the current password is replaced with a random one nobody
+	// knows, so the reset email is the only way back in
+	password, err := app.randomPassword()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.revokeSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		err := app.mailer.Send(user.Email, "token_password_reset.tmpl", map[string]interface{}{
+			"passwordResetToken": token.Plaintext,
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "password reset instructions have been sent to the user"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.getIdFromRequestContext(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// deleting the user cascades to the tokens, the signed
+	// access tokens issued with them have to be denied first
+	err = app.revokeSessions(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user deleted successfully."}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createImpersonationTokenHandler lets support staff act as a user for a
+// short while. Requests made with the token are audited, and it can't be
+// used to take over the account, see preventImpersonation.
+func (app *application) createImpersonationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	target, ok := app.readUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	actor := app.contextGetUser(r)
+
+	if target.ID == actor.ID {
+		v := validator.New()
+		v.AddError("id", "must not be your own user")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// impersonating someone with more permissions would be a way to get them
+	permissions, err := app.models.Permissions.GetAllForUser(target.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, code := range permissions {
+		if !app.hasPermission(r, code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+	}
+
+	token, err := app.models.Tokens.NewImpersonation(target.ID, actor.ID, 15*time.Minute, r.UserAgent(), realip.FromRequest(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo("impersonation started", map[string]string{
+		"impersonator_id": strconv.FormatInt(actor.ID, 10),
+		"user_id":         strconv.FormatInt(target.ID, 10),
+	})
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
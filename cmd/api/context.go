@@ -5,11 +5,20 @@ import (
 	"net/http"
 
 	"github.com/mnabil1718/greenlight/internal/data"
+	"github.com/mnabil1718/greenlight/internal/jwt"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey         = contextKey("user")
+	tokenContextKey        = contextKey("token")
+	permissionsContextKey  = contextKey("permissions")
+	apiKeyContextKey       = contextKey("apiKey")
+	claimsContextKey       = contextKey("claims")
+	impersonatorContextKey = contextKey("impersonator")
+	organizationContextKey = contextKey("organization")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -23,3 +32,93 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// the plaintext bearer token the request was authenticated
+// with, empty for anonymous requests
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetToken(r *http.Request) string {
+	token, ok := r.Context().Value(tokenContextKey).(string)
+	if !ok {
+		return ""
+	}
+	return token
+}
+
+// permissions are resolved once in authenticate
+// and stored next to the user for the request
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetPermissions(r *http.Request) data.Permissions {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	if !ok {
+		panic("missing permissions value in request context")
+	}
+	return permissions
+}
+
+// the API key the request was authenticated
+// with, nil for token and anonymous requests
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, ok := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	if !ok {
+		return nil
+	}
+	return key
+}
+
+// the claims of a signed token, nil for other requests. The user
+// in context then only carries what the claims say about it.
+func (app *application) contextSetClaims(r *http.Request, claims *jwt.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetClaims(r *http.Request) *jwt.Claims {
+	claims, ok := r.Context().Value(claimsContextKey).(*jwt.Claims)
+	if !ok {
+		return nil
+	}
+	return claims
+}
+
+// the admin behind an impersonation token, while contextGetUser
+// returns the impersonated user. nil for everyone else.
+func (app *application) contextSetImpersonator(r *http.Request, impersonator *data.User) *http.Request {
+	ctx := context.WithValue(r.Context(), impersonatorContextKey, impersonator)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetImpersonator(r *http.Request) *data.User {
+	impersonator, ok := r.Context().Value(impersonatorContextKey).(*data.User)
+	if !ok {
+		return nil
+	}
+	return impersonator
+}
+
+// the user's membership in the organization the request acts
+// in, only set on routes wrapped in requireOrganization
+func (app *application) contextSetOrganization(r *http.Request, membership *data.Membership) *http.Request {
+	ctx := context.WithValue(r.Context(), organizationContextKey, membership)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetOrganization(r *http.Request) *data.Membership {
+	membership, ok := r.Context().Value(organizationContextKey).(*data.Membership)
+	if !ok {
+		panic("missing organization value in request context")
+	}
+	return membership
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func (app *application) logError(r *http.Request, err error) {
@@ -57,6 +60,12 @@ func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+func (app *application) loginLockedResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authenticaiton credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -82,3 +91,38 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) mfaUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "two-factor authentication is not configured on this server"
+	app.errorResponse(w, r, http.StatusNotImplemented, message)
+}
+
+func (app *application) mfaRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account must have two-factor authentication enabled to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) oidcUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "single sign-on is not configured on this server"
+	app.errorResponse(w, r, http.StatusNotImplemented, message)
+}
+
+func (app *application) oidcProviderErrorResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the identity provider could not complete the login"
+	app.errorResponse(w, r, http.StatusBadGateway, message)
+}
+
+func (app *application) unverifiedIdentityResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the identity provider did not supply a verified email address"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) organizationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you belong to more than one organization, pick one with the X-Organization-ID header"
+	app.errorResponse(w, r, http.StatusBadRequest, message)
+}
+
+func (app *application) impersonationNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this action is not available while impersonating a user"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
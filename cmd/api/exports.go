@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mnabil1718/greenlight/internal/data"
+	"github.com/mnabil1718/greenlight/internal/validator"
+)
+
+// UserExport is the archive handed out by the personal data export,
+// everything we keep about the user is gathered here
+type UserExport struct {
+	ExportedAt      time.Time          `json:"exported_at"`
+	User            *data.User         `json:"user"`
+	Sessions        []*data.Token      `json:"sessions"`
+	RefreshSessions []*data.Token      `json:"refresh_sessions"`
+	APIKeys         []*data.APIKey     `json:"api_keys"`
+	Identities      []*data.Identity   `json:"identities"`
+	Organizations   []*data.Membership `json:"organizations"`
+	MFA             *UserExportMFA     `json:"mfa"`
+	Permissions     data.Permissions   `json:"permissions"`
+	Movies          []*data.Movie      `json:"movies"`
+	Audit           []*data.AuditEntry `json:"audit"`
+}
+
+// UserExportMFA is the enrollment status only, the secret
+// and recovery codes stay out of the archive
+type UserExportMFA struct {
+	Enabled   bool       `json:"enabled"`
+	CreatedAt time.Time  `json:"created_at"`
+	EnabledAt *time.Time `json:"enabled_at,omitempty"`
+}
+
+func (app *application) createUserExportHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	// the archive is built after the response is sent,
+	// the user gets a download link by email once it's done
+	app.background(func() {
+		err := app.exportUserData(user)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"user_id": fmt.Sprint(user.ID),
+			})
+		}
+	})
+
+	err := app.writeJSON(w, http.StatusAccepted, envelope{"message": "an email will be sent to you containing a link to your data export"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) exportUserData(user *data.User) error {
+	sessions, err := app.models.Tokens.GetAllForUser(data.ScopeAuthentication, user.ID)
+	if err != nil {
+		return err
+	}
+
+	refreshSessions, err := app.models.Tokens.GetAllForUser(data.ScopeRefresh, user.ID)
+	if err != nil {
+		return err
+	}
+
+	apiKeys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	identities, err := app.models.Identities.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	organizations, err := app.models.Organizations.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	var exportMFA *UserExportMFA
+	mfa, err := app.models.MFA.Get(user.ID)
+	switch {
+	case err == nil:
+		exportMFA = &UserExportMFA{Enabled: mfa.Enabled, CreatedAt: mfa.CreatedAt, EnabledAt: mfa.EnabledAt}
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return err
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	movies, err := app.models.Movies.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	audit, err := app.models.Audit.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	archive, err := json.MarshalIndent(UserExport{
+		ExportedAt:      time.Now(),
+		User:            user,
+		Sessions:        sessions,
+		RefreshSessions: refreshSessions,
+		APIKeys:         apiKeys,
+		Identities:      identities,
+		Organizations:   organizations,
+		MFA:             exportMFA,
+		Permissions:     permissions,
+		Movies:          movies,
+		Audit:           audit,
+	}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeDataExport)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.Exports.Insert(token, archive)
+	if err != nil {
+		return err
+	}
+
+	return app.mailer.Send(user.Email, "user_data_export.tmpl", map[string]interface{}{
+		"downloadURL": fmt.Sprintf("%s/v1/exports/%s", app.config.baseURL, token.Plaintext),
+	})
+}
+
+func (app *application) showUserExportHandler(w http.ResponseWriter, r *http.Request) {
+	token := httprouter.ParamsFromContext(r.Context()).ByName("token")
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	archive, err := app.models.Exports.GetForToken(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="greenlight-export.json"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(archive)
+}
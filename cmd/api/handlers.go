@@ -16,7 +16,8 @@ import (
 type ListMovieRequest struct {
 	Title        string
 	Genres       []string
-	data.Filters // can be accessed like: list.Sort OR list.Filters.Sort
+	CreatedBy    int // 0 means any user
+	data.Filters     // can be accessed like: list.Sort OR list.Filters.Sort
 }
 
 type CreateMovieRequest struct {
@@ -56,17 +57,22 @@ func (app *application) listMovieHandler(writer http.ResponseWriter, request *ht
 
 	listMovieRequest.Title = app.readString(queryString, "title", "")
 	listMovieRequest.Genres = app.readCSV(queryString, "genres", []string{})
+	listMovieRequest.CreatedBy = app.readInt(queryString, "created_by", 0, validator)
 	listMovieRequest.PageSize = app.readInt(queryString, "page_size", 20, validator)
 	listMovieRequest.Page = app.readInt(queryString, "page", 1, validator)
 	listMovieRequest.Sort = app.readString(queryString, "sort", "id")
 	listMovieRequest.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
 
+	validator.Check(listMovieRequest.CreatedBy >= 0, "created_by", "must not be negative")
+
 	if data.ValidateFilters(validator, &listMovieRequest.Filters); !validator.Valid() {
 		app.failedValidationResponse(writer, request, validator.Errors)
 		return
 	}
 
-	movies, metadata, err := app.models.Movies.GetAll(listMovieRequest.Title, listMovieRequest.Genres, listMovieRequest.Filters)
+	org := app.contextGetOrganization(request)
+
+	movies, metadata, err := app.models.Movies.GetAll(org.OrganizationID, listMovieRequest.Title, listMovieRequest.Genres, int64(listMovieRequest.CreatedBy), listMovieRequest.Filters)
 	if err != nil {
 		app.serverErrorResponse(writer, request, err)
 		return
@@ -89,11 +95,16 @@ func (app *application) createMovieHandler(writer http.ResponseWriter, request *
 		return
 	}
 
+	user := app.contextGetUser(request)
+	org := app.contextGetOrganization(request)
+
 	movie := &data.Movie{
-		Title:   createMovieRequest.Title,
-		Year:    createMovieRequest.Year,
-		Runtime: createMovieRequest.Runtime,
-		Genres:  createMovieRequest.Genres,
+		OrganizationID: org.OrganizationID,
+		Title:          createMovieRequest.Title,
+		Year:           createMovieRequest.Year,
+		Runtime:        createMovieRequest.Runtime,
+		Genres:         createMovieRequest.Genres,
+		CreatedBy:      &user.ID,
 	}
 
 	v := validator.New()
@@ -125,7 +136,7 @@ func (app *application) showMovieHandler(writer http.ResponseWriter, request *ht
 		return
 	}
 
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(app.contextGetOrganization(request).OrganizationID, id)
 	if err != nil {
 		if errors.Is(err, data.ErrRecordNotFound) {
 			app.notFoundResponse(writer, request)
@@ -158,7 +169,7 @@ func (app *application) updateMovieHandler(writer http.ResponseWriter, request *
 		return
 	}
 
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(app.contextGetOrganization(request).OrganizationID, id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -171,6 +182,11 @@ func (app *application) updateMovieHandler(writer http.ResponseWriter, request *
 		}
 	}
 
+	if !app.canModifyMovie(request, movie) {
+		app.notPermittedResponse(writer, request)
+		return
+	}
+
 	if request.Header.Get("X-Expected-Version") != "" {
 		if strconv.FormatInt(int64(movie.Version), 32) != request.Header.Get("X-Expected-Version") {
 			app.editConflictResponse(writer, request)
@@ -224,7 +240,23 @@ func (app *application) deleteMovieHandler(writer http.ResponseWriter, request *
 		return
 	}
 
-	err = app.models.Movies.Delete(id)
+	movie, err := app.models.Movies.Get(app.contextGetOrganization(request).OrganizationID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(writer, request)
+		default:
+			app.serverErrorResponse(writer, request, err)
+		}
+		return
+	}
+
+	if !app.canModifyMovie(request, movie) {
+		app.notPermittedResponse(writer, request)
+		return
+	}
+
+	err = app.models.Movies.Delete(movie.OrganizationID, movie.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -241,3 +273,20 @@ func (app *application) deleteMovieHandler(writer http.ResponseWriter, request *
 		app.serverErrorResponse(writer, request, err)
 	}
 }
+
+// only the user who created a movie may change it, unless they
+// are an admin of its organization or hold movies:admin, which
+// covers every movie of the organizations they belong to
+func (app *application) canModifyMovie(request *http.Request, movie *data.Movie) bool {
+	user := app.contextGetUser(request)
+
+	if movie.CreatedBy != nil && *movie.CreatedBy == user.ID {
+		return true
+	}
+
+	if app.contextGetOrganization(request).HasRole(data.OrganizationRoleAdmin) {
+		return true
+	}
+
+	return app.hasPermission(request, "movies:admin")
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/base32"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -150,6 +152,23 @@ func (app *application) readInt(queryString url.Values, key string, defaultValue
 	return intValue
 }
 
+// readBool returns nil when the key is missing, so
+// callers can tell "not filtered" apart from false
+func (app *application) readBool(queryString url.Values, key string, validator *validator.Validator) *bool {
+	value := queryString.Get(key)
+	if value == "" {
+		return nil
+	}
+
+	boolValue, err := strconv.ParseBool(value)
+	if err != nil {
+		validator.AddError(key, fmt.Sprintf("%s must be a boolean value.", key))
+		return nil
+	}
+
+	return &boolValue
+}
+
 func (app *application) readCSV(queryString url.Values, key string, defaultValues []string) []string {
 	value := queryString.Get(key)
 	if value == "" {
@@ -174,3 +193,15 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// randomPassword returns a password nobody knows, for
+// accounts that have to go through a password reset
+func (app *application) randomPassword() (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
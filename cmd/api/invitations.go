@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mnabil1718/greenlight/internal/data"
+	"github.com/mnabil1718/greenlight/internal/validator"
+)
+
+type CreateInvitationRequest struct {
+	Email       string     `json:"email"`
+	Roles       []string   `json:"roles"`
+	Permissions []string   `json:"permissions"`
+	ExpiryTime  *time.Time `json:"expiry_time"` // defaults to a week from now
+}
+
+func (app *application) createInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var createInvitationRequest CreateInvitationRequest
+
+	err := app.readJSON(w, r, &createInvitationRequest)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// handing out grants is what permissions:admin is for,
+	// admin:users alone can only invite with the default role
+	if len(createInvitationRequest.Roles) > 0 || len(createInvitationRequest.Permissions) > 0 {
+		if !app.hasPermission(r, "permissions:admin") {
+			app.notPermittedResponse(w, r)
+			return
+		}
+	}
+
+	inviter := app.contextGetUser(r)
+
+	invitation := &data.Invitation{
+		Email:       createInvitationRequest.Email,
+		Roles:       createInvitationRequest.Roles,
+		Permissions: createInvitationRequest.Permissions,
+		InvitedBy:   &inviter.ID,
+		ExpiryTime:  time.Now().Add(7 * 24 * time.Hour),
+	}
+
+	if createInvitationRequest.ExpiryTime != nil {
+		invitation.ExpiryTime = *createInvitationRequest.ExpiryTime
+	}
+
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateInvitation(v, invitation, roles, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Users.GetByEmail(invitation.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Invitations.New(invitation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		err := app.mailer.Send(invitation.Email, "user_invitation.tmpl", map[string]interface{}{
+			"email":          invitation.Email,
+			"invitationCode": invitation.Plaintext,
+			"expiryTime":     invitation.ExpiryTime.Format(time.RFC1123),
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"invitation": invitation}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readInvitation looks up the invitation for a registration,
+// responding itself when the code is missing or unusable
+func (app *application) readInvitation(w http.ResponseWriter, r *http.Request, code string) (*data.Invitation, bool) {
+	v := validator.New()
+
+	v.Check(code != "", "invitation_code", "must be provided")
+	v.Check(code == "" || len(code) == 26, "invitation_code", "must be 26 bytes long")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	invitation, err := app.models.Invitations.GetForCode(code)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("invitation_code", "invalid or expired invitation code")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return invitation, true
+}
+
+// acceptInvitation finishes registering an invited user, who is
+// already activated, by giving them the invitation's grants
+func (app *application) acceptInvitation(w http.ResponseWriter, r *http.Request, user *data.User, invitation *data.Invitation) {
+	err := app.models.Invitations.Accept(invitation.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			// accepted by a concurrent registration, undo this one
+			err = app.models.Users.Delete(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			v := validator.New()
+			v.AddError("invitation_code", "invalid or expired invitation code")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.grantInvitation(user, invitation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// grantInvitation gives the user the invitation's roles, or the
+// default role when it has none, and its permissions
+func (app *application) grantInvitation(user *data.User, invitation *data.Invitation) error {
+	roles := invitation.Roles
+	if len(roles) == 0 {
+		roles = []string{app.config.defaultRole}
+	}
+
+	err := app.models.Roles.AddForUser(user.ID, roles...)
+	if err != nil {
+		return err
+	}
+
+	if len(invitation.Permissions) > 0 {
+		return app.models.Permissions.AddForUser(user.ID, invitation.Permissions...)
+	}
+
+	return nil
+}
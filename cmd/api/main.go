@@ -1,18 +1,25 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/mnabil1718/greenlight/internal/crypt"
 	"github.com/mnabil1718/greenlight/internal/data"
 	"github.com/mnabil1718/greenlight/internal/jsonlog"
+	"github.com/mnabil1718/greenlight/internal/jwt"
 	"github.com/mnabil1718/greenlight/internal/mailer"
+	"github.com/mnabil1718/greenlight/internal/oidc"
 )
 
 var (
@@ -21,10 +28,11 @@ var (
 )
 
 type config struct {
-	port int
-	env  string
-	host string
-	db   struct {
+	port    int
+	env     string
+	host    string
+	baseURL string
+	db      struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
@@ -45,6 +53,47 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	login struct {
+		maxFailures        int
+		maxIPFailures      int
+		lockoutDuration    time.Duration
+		maxLockoutDuration time.Duration
+	}
+	mfa struct {
+		encryptionKey string
+		key           []byte
+		issuer        string
+		required      bool
+	}
+	tokens struct {
+		ttl             time.Duration
+		refreshTTL      time.Duration
+		format          string
+		signedTTL       time.Duration
+		signingKeys     []string
+		signingKeyID    string
+		denylistRefresh time.Duration
+	}
+	oidc struct {
+		issuer       string
+		clientID     string
+		clientSecret string
+		redirectURL  string
+		authURL      string
+		tokenURL     string
+		jwksURL      string
+	}
+	password data.PasswordConfig
+	policy   struct {
+		minEntropy float64
+		breachDir  string
+	}
+	defaultRole         string
+	defaultOrganization int64
+	inviteOnly          bool
+	permissions         struct {
+		cacheTTL string
+	}
 }
 
 type application struct {
@@ -52,16 +101,20 @@ type application struct {
 	config config
 	models data.Models
 	mailer mailer.Mailer
+	signer *jwt.Signer    // nil unless token signing keys are configured
+	oidc   *oidc.Provider // nil unless single sign-on is configured
 	wg     sync.WaitGroup
 }
 
 func main() {
 	var cfg config
+	cfg.password = data.DefaultPasswordConfig
 
 	flag.StringVar(&cfg.host, "host", "localhost", "Application Server Hostname")
 	flag.IntVar(&cfg.port, "port", 8080, "Application Server Port Number")
 	flag.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL Connection String")
 	flag.StringVar(&cfg.env, "env", "dev", "Application Environment: (dev|staging|prod)")
+	flag.StringVar(&cfg.baseURL, "base-url", "http://localhost:8080", "Public base URL used in links sent by email")
 
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
@@ -77,11 +130,65 @@ func main() {
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "373c5780d64d98", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.mnabil.net>", "SMTP sender")
 
+	flag.IntVar(&cfg.login.maxFailures, "login-max-failures", 5, "Failed logins before an account is locked")
+	flag.IntVar(&cfg.login.maxIPFailures, "login-max-ip-failures", 20, "Failed logins before a client IP is locked")
+	flag.DurationVar(&cfg.login.lockoutDuration, "login-lockout-duration", 5*time.Minute, "Duration of the first lockout, doubled for each consecutive one")
+	flag.DurationVar(&cfg.login.maxLockoutDuration, "login-max-lockout-duration", 24*time.Hour, "Maximum lockout duration")
+
+	flag.DurationVar(&cfg.tokens.ttl, "token-ttl", 15*time.Minute, "Lifetime of authentication tokens")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "refresh-token-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+	flag.StringVar(&cfg.tokens.format, "token-format", "opaque", "Authentication token format (opaque|signed)")
+	flag.DurationVar(&cfg.tokens.signedTTL, "signed-token-ttl", 15*time.Minute, "Lifetime of signed authentication tokens, permission changes apply once they expire")
+	flag.Func("token-signing-keys", "Token signing keys as kid:alg:base64key, alg is HS256 or EdDSA (space separated)", func(val string) error {
+		cfg.tokens.signingKeys = strings.Fields(val)
+		return nil
+	})
+	flag.StringVar(&cfg.tokens.signingKeyID, "token-signing-kid", "", "ID of the key new signed tokens are signed with")
+	flag.DurationVar(&cfg.tokens.denylistRefresh, "token-denylist-refresh", 30*time.Second, "How often revoked signed tokens are reloaded from the database")
+
+	flag.StringVar(&cfg.mfa.encryptionKey, "mfa-encryption-key", "", "Hex encoded 32 byte key used to encrypt TOTP secrets")
+	flag.StringVar(&cfg.mfa.issuer, "mfa-issuer", "Greenlight", "Issuer name shown in authenticator apps")
+	flag.BoolVar(&cfg.mfa.required, "mfa-required", false, "Require two-factor authentication for movies:write")
+
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
 		cfg.cors.trustedOrigins = strings.Fields(val)
 		return nil
 	})
 
+	flag.StringVar(&cfg.password.Algorithm, "password-algorithm", data.DefaultPasswordConfig.Algorithm, "Password hashing algorithm (argon2id|bcrypt), existing hashes are upgraded on login")
+	flag.IntVar(&cfg.password.BcryptCost, "password-bcrypt-cost", data.DefaultPasswordConfig.BcryptCost, "bcrypt cost")
+	flag.Func("password-argon2-memory", "argon2id memory in KiB (default 65536)", func(val string) error {
+		memory, err := strconv.ParseUint(val, 10, 32)
+		cfg.password.Argon2Memory = uint32(memory)
+		return err
+	})
+	flag.Func("password-argon2-time", "argon2id number of passes (default 3)", func(val string) error {
+		time, err := strconv.ParseUint(val, 10, 32)
+		cfg.password.Argon2Time = uint32(time)
+		return err
+	})
+	flag.Func("password-argon2-threads", "argon2id degree of parallelism (default 2)", func(val string) error {
+		threads, err := strconv.ParseUint(val, 10, 8)
+		cfg.password.Argon2Threads = uint8(threads)
+		return err
+	})
+
+	flag.Float64Var(&cfg.policy.minEntropy, "password-min-entropy", 35, "Minimum estimated password strength in bits")
+	flag.StringVar(&cfg.policy.breachDir, "password-breach-dir", "", "Directory of breached password SHA-1 range files (PREFIX files of SUFFIX:COUNT lines), disabled when empty")
+
+	flag.StringVar(&cfg.oidc.issuer, "oidc-issuer", "", "OpenID Connect issuer URL, enables single sign-on")
+	flag.StringVar(&cfg.oidc.clientID, "oidc-client-id", "", "OpenID Connect client ID")
+	flag.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", "", "OpenID Connect client secret")
+	flag.StringVar(&cfg.oidc.redirectURL, "oidc-redirect-url", "", "OpenID Connect redirect URL (default base-url + /v1/oidc/callback)")
+	flag.StringVar(&cfg.oidc.authURL, "oidc-auth-url", "", "OpenID Connect authorization endpoint, discovered when empty")
+	flag.StringVar(&cfg.oidc.tokenURL, "oidc-token-url", "", "OpenID Connect token endpoint, discovered when empty")
+	flag.StringVar(&cfg.oidc.jwksURL, "oidc-jwks-url", "", "OpenID Connect JWKS URL, discovered when empty")
+
+	flag.StringVar(&cfg.defaultRole, "default-role", "user", "Role assigned to newly registered users")
+	flag.Int64Var(&cfg.defaultOrganization, "default-organization", 1, "Organization newly registered users join as members, 0 to disable")
+	flag.BoolVar(&cfg.inviteOnly, "invite-only", false, "Only allow registration with an invitation code")
+	flag.StringVar(&cfg.permissions.cacheTTL, "permissions-cache-ttl", "1m", "How long user permissions are cached in memory, 0 to disable")
+
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
 	flag.Parse()
@@ -94,6 +201,86 @@ func main() {
 
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
+	if cfg.mfa.encryptionKey != "" {
+		key, err := hex.DecodeString(cfg.mfa.encryptionKey)
+		if err != nil || len(key) != crypt.KeySize {
+			logger.PrintFatal(errors.New("mfa-encryption-key must be a hex encoded 32 byte key"), nil)
+		}
+		cfg.mfa.key = key
+	} else if cfg.mfa.required {
+		logger.PrintFatal(errors.New("mfa-required needs an mfa-encryption-key"), nil)
+	}
+
+	err := data.SetPasswordConfig(cfg.password)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	policy := data.PasswordPolicy{
+		Rules: []data.PasswordRule{data.MinEntropyRule{Bits: cfg.policy.minEntropy}, data.PersonalInfoRule{}},
+	}
+	if cfg.policy.breachDir != "" {
+		info, err := os.Stat(cfg.policy.breachDir)
+		if err != nil || !info.IsDir() {
+			logger.PrintFatal(errors.New("password-breach-dir must be an existing directory"), nil)
+		}
+		policy.Rules = append(policy.Rules, data.BreachedPasswordRule{Dir: cfg.policy.breachDir})
+	}
+	data.SetPasswordPolicy(policy)
+
+	var signer *jwt.Signer
+	if len(cfg.tokens.signingKeys) > 0 {
+		keys := []*jwt.Key{}
+		for _, spec := range cfg.tokens.signingKeys {
+			key, err := jwt.ParseKey(spec)
+			if err != nil {
+				logger.PrintFatal(err, nil)
+			}
+			keys = append(keys, key)
+		}
+
+		var err error
+		signer, err = jwt.NewSigner(keys, cfg.tokens.signingKeyID)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	switch cfg.tokens.format {
+	case "opaque":
+	case "signed":
+		if signer == nil {
+			logger.PrintFatal(errors.New("token-format signed needs token-signing-keys"), nil)
+		}
+	default:
+		logger.PrintFatal(errors.New("token-format must be opaque or signed"), nil)
+	}
+
+	var provider *oidc.Provider
+	if cfg.oidc.issuer != "" {
+		if cfg.oidc.redirectURL == "" {
+			cfg.oidc.redirectURL = strings.TrimSuffix(cfg.baseURL, "/") + "/v1/oidc/callback"
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var err error
+		provider, err = oidc.New(ctx, oidc.Config{
+			Issuer:       cfg.oidc.issuer,
+			ClientID:     cfg.oidc.clientID,
+			ClientSecret: cfg.oidc.clientSecret,
+			RedirectURL:  cfg.oidc.redirectURL,
+			AuthURL:      cfg.oidc.authURL,
+			TokenURL:     cfg.oidc.tokenURL,
+			JWKSURL:      cfg.oidc.jwksURL,
+			ClockSkew:    time.Minute,
+		})
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
 	db, err := openDB(cfg)
 	if err != nil {
 		logger.PrintFatal(err, nil)
@@ -102,6 +289,11 @@ func main() {
 
 	logger.PrintInfo("database connection pool established successfully.", nil)
 
+	permissionsCacheTTL, err := time.ParseDuration(cfg.permissions.cacheTTL)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	expvar.NewString("version").Set(version)
 
 	expvar.Publish("goroutines", expvar.Func(func() interface{} {
@@ -119,8 +311,14 @@ func main() {
 	app := application{
 		logger: logger,
 		config: cfg,
-		models: data.NewModels(db),
+		models: data.NewModels(db, permissionsCacheTTL),
 		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		signer: signer,
+		oidc:   provider,
+	}
+
+	if signer != nil {
+		go app.refreshDenylist()
 	}
 
 	err = app.serve()
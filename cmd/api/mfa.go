@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mnabil1718/greenlight/internal/crypt"
+	"github.com/mnabil1718/greenlight/internal/data"
+	"github.com/mnabil1718/greenlight/internal/totp"
+	"github.com/mnabil1718/greenlight/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+type CreateMFAEnrollmentRequest struct {
+	CurrentPassword string `json:"current_password"`
+}
+
+type ConfirmMFAEnrollmentRequest struct {
+	Code string `json:"code"`
+}
+
+type DeleteMFARequest struct {
+	CurrentPassword string `json:"current_password"`
+	Code            string `json:"code"`
+	RecoveryCode    string `json:"recovery_code"`
+}
+
+type CreateMFAAuthTokenRequest struct {
+	TokenPlainText string `json:"token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+	Label          string `json:"label"`
+}
+
+func (app *application) createMFAEnrollmentHandler(w http.ResponseWriter, r *http.Request) {
+	if len(app.config.mfa.key) == 0 {
+		app.mfaUnavailableResponse(w, r)
+		return
+	}
+
+	var createMFAEnrollmentRequest CreateMFAEnrollmentRequest
+	err := app.readJSON(w, r, &createMFAEnrollmentRequest)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+	v.Check(createMFAEnrollmentRequest.CurrentPassword != "", "current_password", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ok, err := user.Password.Matches(createMFAEnrollmentRequest.CurrentPassword)
+	if !ok {
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		} else {
+			v.AddError("current_password", "does not match your current password")
+			app.failedValidationResponse(w, r, v.Errors)
+		}
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	encryptedSecret, err := crypt.Encrypt(app.config.mfa.key, []byte(secret))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.MFA.Enroll(&data.MFA{UserID: user.ID, Secret: encryptedSecret})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v.AddError("mfa", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(app.config.mfa.issuer, user.Email, secret),
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) confirmMFAEnrollmentHandler(w http.ResponseWriter, r *http.Request) {
+	if len(app.config.mfa.key) == 0 {
+		app.mfaUnavailableResponse(w, r)
+		return
+	}
+
+	var confirmMFAEnrollmentRequest ConfirmMFAEnrollmentRequest
+	err := app.readJSON(w, r, &confirmMFAEnrollmentRequest)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+	if data.ValidateTOTPCode(v, confirmMFAEnrollmentRequest.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	mfa, err := app.models.MFA.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("mfa", "two-factor authentication enrollment has not been started")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if mfa.Enabled {
+		v.AddError("mfa", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	secret, err := crypt.Decrypt(app.config.mfa.key, mfa.Secret)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	step, ok := totp.Validate(string(secret), confirmMFAEnrollmentRequest.Code, time.Now(), 1)
+	if !ok {
+		v.AddError("code", "invalid authentication code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	recoveryCodes, hashes, err := data.GenerateRecoveryCodes(10)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.MFA.Enable(user.ID, step, hashes)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// recovery codes are only ever shown here, we keep their hashes
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": recoveryCodes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteMFAHandler(w http.ResponseWriter, r *http.Request) {
+	var deleteMFARequest DeleteMFARequest
+	err := app.readJSON(w, r, &deleteMFARequest)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+	v.Check(deleteMFARequest.CurrentPassword != "", "current_password", "must be provided")
+	v.Check(deleteMFARequest.Code != "" || deleteMFARequest.RecoveryCode != "", "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ok, err := user.Password.Matches(deleteMFARequest.CurrentPassword)
+	if !ok {
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		} else {
+			v.AddError("current_password", "does not match your current password")
+			app.failedValidationResponse(w, r, v.Errors)
+		}
+		return
+	}
+
+	mfa, err := app.models.MFA.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// an unconfirmed enrollment can be dropped with the password alone
+	if mfa.Enabled {
+		ok, err = app.verifySecondFactor(mfa, deleteMFARequest.Code, deleteMFARequest.RecoveryCode)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !ok {
+			v.AddError("code", "invalid authentication code")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = app.models.MFA.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication disabled successfully."}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createMFAAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var createMFAAuthTokenRequest CreateMFAAuthTokenRequest
+	err := app.readJSON(w, r, &createMFAAuthTokenRequest)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, createMFAAuthTokenRequest.TokenPlainText)
+	data.ValidateTokenLabel(v, createMFAAuthTokenRequest.Label)
+	if createMFAAuthTokenRequest.RecoveryCode == "" {
+		data.ValidateTOTPCode(v, createMFAAuthTokenRequest.Code)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeMFAPending, createMFAAuthTokenRequest.TokenPlainText)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired mfa token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// wrong codes count as failed logins, so
+	// guessing them runs into the account lockout
+	attempt, err := app.models.LoginAttempts.Get(data.LoginScopeAccount, strconv.FormatInt(user.ID, 10))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if attempt.Locked() {
+		app.loginLockedResponse(w, r, attempt.RetryAfter())
+		return
+	}
+
+	mfa, err := app.models.MFA.Get(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ok, err := app.verifySecondFactor(mfa, createMFAAuthTokenRequest.Code, createMFAAuthTokenRequest.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ip := realip.FromRequest(r)
+
+	if !ok {
+		app.failedLoginResponse(w, r, ip, user)
+		return
+	}
+
+	err = app.resetFailedLogins(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.DeleteForAllUser(data.ScopeMFAPending, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.issueSessionToken(w, r, user, createMFAAuthTokenRequest.Label, 0)
+}
+
+// verifySecondFactor checks a TOTP code, or a recovery code when one
+// is given. Accepted codes are burned so they can't be used again.
+func (app *application) verifySecondFactor(mfa *data.MFA, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return app.models.MFA.UseRecoveryCode(mfa.UserID, recoveryCode)
+	}
+
+	if len(app.config.mfa.key) == 0 {
+		return false, errors.New("mfa encryption key is not configured")
+	}
+
+	secret, err := crypt.Decrypt(app.config.mfa.key, mfa.Secret)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := totp.Validate(string(secret), code, time.Now(), 1)
+	if !ok {
+		return false, nil
+	}
+
+	return app.models.MFA.UseStep(mfa.UserID, step)
+}
@@ -86,16 +86,82 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 	})
 }
 
+// rateLimitUser limits each authenticated user to burst requests,
+// refilled one every interval. It is for expensive routes on top
+// of the per IP limit, so it shares its enabled switch.
+func (app *application) rateLimitUser(interval time.Duration, burst int, next http.HandlerFunc) http.HandlerFunc {
+
+	var (
+		mutex   sync.Mutex
+		clients map[int64]*Client = make(map[int64]*Client)
+	)
+
+	// a user not seen for long enough has a full
+	// limiter again, there's no need to keep it
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			mutex.Lock()
+
+			for key, client := range clients {
+				if time.Since(client.lastSeenTime) > interval*time.Duration(burst) {
+					delete(clients, key)
+				}
+			}
+
+			mutex.Unlock()
+		}
+	}()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if app.config.limiter.enabled {
+			user := app.contextGetUser(r)
+
+			mutex.Lock()
+
+			if _, ok := clients[user.ID]; !ok {
+				clients[user.ID] = &Client{limiter: rate.NewLimiter(rate.Every(interval), burst)}
+			}
+
+			clients[user.ID].lastSeenTime = time.Now()
+
+			if !clients[user.ID].limiter.Allow() {
+				mutex.Unlock()
+				app.rateLimitExceededResponse(w, r)
+				return
+			}
+
+			mutex.Unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
 		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
+		apiKey := r.Header.Get("X-API-Key")
+		if authHeader == "" && apiKey == "" {
 			r = app.contextSetUser(r, data.AnonymousUser)
+			r = app.contextSetPermissions(r, data.Permissions{})
 			next.ServeHTTP(w, r)
 			return
 		}
 
+		if apiKey != "" {
+			// sending both headers is ambiguous, refuse to pick one
+			if authHeader != "" {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			app.authenticateAPIKey(w, r, next, apiKey)
+			return
+		}
+
 		headerParts := strings.Split(authHeader, " ")
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
@@ -103,6 +169,17 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		token := headerParts[1]
+		if data.IsAPIKey(token) {
+			app.authenticateAPIKey(w, r, next, token)
+			return
+		}
+
+		// opaque tokens are base32, only signed tokens contain dots
+		if strings.Contains(token, ".") {
+			app.authenticateSignedToken(w, r, next, token)
+			return
+		}
+
 		v := validator.New()
 
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
@@ -110,7 +187,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		session, user, err := app.models.Tokens.GetSession(token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -121,11 +198,135 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		err = app.models.Tokens.Touch(session.Hash)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if session.ImpersonatorID != nil {
+			impersonator, err := app.models.Users.Get(*session.ImpersonatorID)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			// the token outlives the grant it was issued under, so the
+			// impersonator has to still be allowed to use it
+			impersonatorPermissions, err := app.models.Permissions.GetAllForUser(impersonator.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			if !impersonator.Activated || !impersonatorPermissions.Include("admin:impersonate") {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			r = app.contextSetImpersonator(r, impersonator)
+		}
+
+		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
+		r = app.contextSetPermissions(r, permissions)
 		next.ServeHTTP(w, r)
 	})
 }
 
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	key, user, err := app.models.APIKeys.GetForKey(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.APIKeys.Touch(key.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+	r = app.contextSetPermissions(r, permissions)
+	next.ServeHTTP(w, r)
+}
+
+// authenticateSignedToken trusts the claims of a valid signed token
+// instead of loading the user and their permissions from the database.
+// Routes that need the rest of the user go through requireFullUser.
+func (app *application) authenticateSignedToken(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	if app.signer == nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	claims, err := app.signer.Verify(token, time.Now())
+	if err != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	if app.models.Denylist.Contains(claims.ID) {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || userID < 1 {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	user := &data.User{
+		ID:        userID,
+		Activated: claims.Activated,
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetToken(r, token)
+	r = app.contextSetClaims(r, claims)
+	r = app.contextSetPermissions(r, claims.Permissions)
+	next.ServeHTTP(w, r)
+}
+
+// hasPermission checks the user's permissions and, for requests
+// made with an API key, the subset the key was created with too
+func (app *application) hasPermission(r *http.Request, code string) bool {
+	if !app.contextGetPermissions(r).Include(code) {
+		return false
+	}
+
+	if key := app.contextGetAPIKey(r); key != nil {
+		return key.Permissions.Include(code)
+	}
+
+	return true
+}
+
 // it returns http.HandlerFunc so we could wrap this over our /v1/movies** routes
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -153,17 +354,37 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
-func (app *application) requirePermission(permissionCode string, next http.HandlerFunc) http.HandlerFunc {
+// requireFullUser loads the whole user for requests authenticated
+// with a signed token, whose claims only carry the id and activation
+// status. Other requests already have it.
+func (app *application) requireFullUser(next http.HandlerFunc) http.HandlerFunc {
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user := app.contextGetUser(r)
+		if app.contextGetClaims(r) == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		user, err := app.models.Users.Get(app.contextGetUser(r).ID)
 		if err != nil {
-			app.serverErrorResponse(w, r, err)
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
 			return
 		}
 
-		if !permissions.Include(permissionCode) {
+		r = app.contextSetUser(r, user)
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireAuthenticatedUser(fn)
+}
+
+func (app *application) requirePermission(permissionCode string, next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.hasPermission(r, permissionCode) {
 			app.notPermittedResponse(w, r)
 			return
 		}
@@ -174,6 +395,164 @@ func (app *application) requirePermission(permissionCode string, next http.Handl
 	return app.requireActivatedUser(fn)
 }
 
+// requireOrganization resolves the organization the request acts in
+// and checks the user holds at least role in it. The organization comes
+// from the X-Organization-ID header, then the org claim of a signed
+// token, and otherwise defaults to the user's only organization.
+func (app *application) requireOrganization(role string, next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "X-Organization-ID")
+
+		user := app.contextGetUser(r)
+
+		var orgID int64
+		if header := r.Header.Get("X-Organization-ID"); header != "" {
+			id, err := strconv.ParseInt(header, 10, 64)
+			if err != nil || id < 1 {
+				app.badRequestResponse(w, r, errors.New("invalid X-Organization-ID header"))
+				return
+			}
+			orgID = id
+		} else if claims := app.contextGetClaims(r); claims != nil {
+			orgID = claims.Org
+		}
+
+		var membership *data.Membership
+		if orgID == 0 {
+			memberships, err := app.models.Organizations.GetAllForUser(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			switch len(memberships) {
+			case 0:
+				app.notPermittedResponse(w, r)
+				return
+			case 1:
+				membership = memberships[0]
+			default:
+				app.organizationRequiredResponse(w, r)
+				return
+			}
+		} else {
+			var err error
+			membership, err = app.models.Organizations.GetMember(orgID, user.ID)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.notPermittedResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+		}
+
+		if !membership.HasRole(role) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		r = app.contextSetOrganization(r, membership)
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireActivatedUser(fn)
+}
+
+// preventImpersonation keeps impersonating admins away from
+// credentials and other account settings of the user
+func (app *application) preventImpersonation(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetImpersonator(r) != nil {
+			app.impersonationNotAllowedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// preventAPIKey keeps API keys off the routes that manage the account
+// itself, a key could otherwise get around the restrictions it was
+// given by changing the credentials or minting a new key
+func (app *application) preventAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// audit writes every request made with an impersonation token to the
+// audit log, along with the status it got. It runs after authenticate.
+func (app *application) audit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		impersonator := app.contextGetImpersonator(r)
+		if impersonator == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user := app.contextGetUser(r)
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		entry := &data.AuditEntry{
+			ActorID: impersonator.ID,
+			UserID:  user.ID,
+			Method:  r.Method,
+			Path:    r.URL.Path,
+			Status:  metrics.Code,
+			IP:      realip.FromRequest(r),
+		}
+
+		app.logger.PrintInfo("impersonated request", map[string]string{
+			"impersonator_id": strconv.FormatInt(entry.ActorID, 10),
+			"user_id":         strconv.FormatInt(entry.UserID, 10),
+			"method":          entry.Method,
+			"path":            entry.Path,
+			"status":          strconv.Itoa(entry.Status),
+		})
+
+		app.background(func() {
+			err := app.models.Audit.Insert(entry)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	})
+}
+
+// requireMFA only lets users with two-factor authentication enabled
+// through, when the mfa-required setting is on
+func (app *application) requireMFA(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.mfa.required {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user := app.contextGetUser(r)
+
+		mfa, err := app.models.MFA.Get(user.ID)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if mfa == nil || !mfa.Enabled {
+			app.mfaRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Origin")
@@ -189,7 +568,7 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-API-Key, X-Organization-ID")
 
 						w.WriteHeader(http.StatusOK)
 						return
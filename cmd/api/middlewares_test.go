@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mnabil1718/greenlight/internal/data"
+	"github.com/mnabil1718/greenlight/internal/jsonlog"
+	"github.com/mnabil1718/greenlight/internal/jwt"
+)
+
+// fakeOrganizationModel answers membership lookups from memory
+type fakeOrganizationModel struct {
+	data.MockOrganizationModel
+	memberships []*data.Membership
+}
+
+func (m fakeOrganizationModel) GetAllForUser(userID int64) ([]*data.Membership, error) {
+	memberships := []*data.Membership{}
+	for _, membership := range m.memberships {
+		if membership.UserID == userID {
+			memberships = append(memberships, membership)
+		}
+	}
+	return memberships, nil
+}
+
+func (m fakeOrganizationModel) GetMember(orgID, userID int64) (*data.Membership, error) {
+	for _, membership := range m.memberships {
+		if membership.OrganizationID == orgID && membership.UserID == userID {
+			return membership, nil
+		}
+	}
+	return nil, data.ErrRecordNotFound
+}
+
+func TestRequireOrganization(t *testing.T) {
+	const (
+		single   = 1 // member of organization 1 only
+		multiple = 2 // viewer of 1, member of 2
+		none     = 3 // member of nothing
+	)
+
+	app := &application{
+		logger: jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models: data.Models{
+			Organizations: fakeOrganizationModel{memberships: []*data.Membership{
+				{OrganizationID: 1, UserID: single, Role: data.OrganizationRoleMember},
+				{OrganizationID: 1, UserID: multiple, Role: data.OrganizationRoleViewer},
+				{OrganizationID: 2, UserID: multiple, Role: data.OrganizationRoleMember},
+			}},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		userID     int64
+		header     string
+		claimOrg   int64
+		role       string
+		wantStatus int
+		wantOrg    int64
+		wantBody   string
+	}{
+		{name: "only organization by default", userID: single, role: data.OrganizationRoleViewer, wantStatus: http.StatusOK, wantOrg: 1},
+		{name: "header picks organization", userID: multiple, header: "2", role: data.OrganizationRoleMember, wantStatus: http.StatusOK, wantOrg: 2},
+		{name: "claim picks organization", userID: multiple, claimOrg: 2, role: data.OrganizationRoleMember, wantStatus: http.StatusOK, wantOrg: 2},
+		{name: "header wins over claim", userID: multiple, header: "1", claimOrg: 2, role: data.OrganizationRoleViewer, wantStatus: http.StatusOK, wantOrg: 1},
+		{name: "header for non-member organization", userID: single, header: "2", role: data.OrganizationRoleViewer, wantStatus: http.StatusForbidden},
+		{name: "claim for non-member organization", userID: single, claimOrg: 2, role: data.OrganizationRoleViewer, wantStatus: http.StatusForbidden},
+		{name: "several organizations without header", userID: multiple, role: data.OrganizationRoleViewer, wantStatus: http.StatusBadRequest, wantBody: "X-Organization-ID"},
+		{name: "no organization", userID: none, role: data.OrganizationRoleViewer, wantStatus: http.StatusForbidden},
+		{name: "malformed header", userID: single, header: "abc", role: data.OrganizationRoleViewer, wantStatus: http.StatusBadRequest},
+		{name: "role below required", userID: multiple, header: "1", role: data.OrganizationRoleMember, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *data.Membership
+			next := func(w http.ResponseWriter, r *http.Request) {
+				got = app.contextGetOrganization(r)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Organization-ID", tt.header)
+			}
+			r = app.contextSetUser(r, &data.User{ID: tt.userID, Activated: true})
+			if tt.claimOrg != 0 {
+				r = app.contextSetClaims(r, &jwt.Claims{Org: tt.claimOrg})
+			}
+
+			rr := httptest.NewRecorder()
+			app.requireOrganization(tt.role, next).ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d", rr.Code, tt.wantStatus)
+			}
+
+			if tt.wantOrg != 0 && (got == nil || got.OrganizationID != tt.wantOrg) {
+				t.Errorf("got organization %v; want %d", got, tt.wantOrg)
+			}
+
+			if tt.wantStatus != http.StatusOK && got != nil {
+				t.Errorf("next handler ran for organization %d", got.OrganizationID)
+			}
+
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("got body %q; want it to contain %q", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
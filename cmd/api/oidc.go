@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mnabil1718/greenlight/internal/data"
+	"github.com/mnabil1718/greenlight/internal/oidc"
+	"github.com/mnabil1718/greenlight/internal/validator"
+)
+
+var (
+	errUnusableIdentity   = errors.New("identity has no verified email address")
+	errDeactivatedAccount = errors.New("account was deactivated by an admin")
+	errNotInvited         = errors.New("registration requires an invitation")
+)
+
+// oidcAuthorizeHandler starts a login at the identity provider. The
+// state, nonce and PKCE verifier are kept server side for the callback.
+func (app *application) oidcAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.oidcUnavailableResponse(w, r)
+		return
+	}
+
+	state, err := oidc.NewState()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	nonce, err := oidc.NewState()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	verifier, challenge, err := oidc.NewVerifier()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.OIDCStates.Insert(&data.OIDCState{
+		State:      state,
+		Verifier:   verifier,
+		Nonce:      nonce,
+		ExpiryTime: time.Now().Add(10 * time.Minute),
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, app.oidc.AuthCodeURL(state, nonce, challenge), http.StatusFound)
+}
+
+// oidcCallbackHandler is where the provider sends the browser back to.
+// It finishes the login and responds like createAuthTokenHandler.
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.oidcUnavailableResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+
+	if providerError := qs.Get("error"); providerError != "" {
+		app.badRequestResponse(w, r, fmt.Errorf("identity provider returned %s", providerError))
+		return
+	}
+
+	code := app.readString(qs, "code", "")
+	stateParam := app.readString(qs, "state", "")
+
+	v := validator.New()
+	v.Check(code != "", "code", "must be provided")
+	v.Check(stateParam != "", "state", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	state, err := app.models.OIDCStates.Consume(stateParam)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("state", "invalid or expired state")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	rawIDToken, err := app.oidc.Exchange(ctx, code, state.Verifier)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		app.oidcProviderErrorResponse(w, r)
+		return
+	}
+
+	idToken, err := app.oidc.Verify(ctx, rawIDToken, state.Nonce)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	user, err := app.userForIdentity(idToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnusableIdentity):
+			app.unverifiedIdentityResponse(w, r)
+		case errors.Is(err, errDeactivatedAccount):
+			app.inactivateAccountResponse(w, r)
+		case errors.Is(err, errNotInvited):
+			// what registering without an invitation code gets
+			v := validator.New()
+			v.AddError("invitation_code", "must be provided")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.issueAuthenticationToken(w, r, user, "")
+}
+
+// userForIdentity returns the user linked to the identity. Unlinked
+// identities are linked to the user with the same email, which the
+// provider must have verified, or to a new activated user. Accounts
+// an admin deactivated can't log in this way.
+func (app *application) userForIdentity(idToken *oidc.IDToken) (*data.User, error) {
+	identity, err := app.models.Identities.Get(idToken.Issuer, idToken.Subject)
+	if err == nil {
+		user, err := app.models.Users.Get(identity.UserID)
+		if err != nil {
+			return nil, err
+		}
+
+		if !user.Activated && user.DeactivatedAt != nil {
+			return nil, errDeactivatedAccount
+		}
+
+		return user, nil
+	}
+
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	if idToken.Email == "" || !idToken.EmailVerified {
+		return nil, errUnusableIdentity
+	}
+
+	user, err := app.models.Users.GetByEmail(idToken.Email)
+	switch {
+	case err == nil:
+		if !user.Activated && user.DeactivatedAt != nil {
+			return nil, errDeactivatedAccount
+		}
+
+		// the provider vouches for the address, which is what
+		// activation proves for accounts that never completed it
+		if !user.Activated {
+			user.Activated = true
+			err = app.models.Users.Update(user)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case errors.Is(err, data.ErrRecordNotFound):
+		user, err = app.createIdentityUser(idToken)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	err = app.models.Identities.Insert(&data.Identity{
+		UserID:  user.ID,
+		Issuer:  idToken.Issuer,
+		Subject: idToken.Subject,
+		Email:   idToken.Email,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// createIdentityUser registers the user behind a new identity. While
+// registration is invite-only, the email must have a pending invitation,
+// which is accepted and decides the grants like it does for registration.
+func (app *application) createIdentityUser(idToken *oidc.IDToken) (*data.User, error) {
+	var invitation *data.Invitation
+	if app.config.inviteOnly {
+		var err error
+		invitation, err = app.models.Invitations.GetForEmail(idToken.Email)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				return nil, errNotInvited
+			default:
+				return nil, err
+			}
+		}
+	}
+
+	name := idToken.Name
+	if name == "" {
+		name, _, _ = strings.Cut(idToken.Email, "@")
+	}
+
+	user := &data.User{
+		Name:      name,
+		Email:     idToken.Email,
+		Activated: true,
+	}
+
+	// there is no password to log in with until the
+	// user sets one through a password reset
+	password, err := app.randomPassword()
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return nil, err
+	}
+
+	v := validator.New()
+	if data.ValidateUser(v, user); !v.Valid() {
+		return nil, errUnusableIdentity
+	}
+
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.joinDefaultOrganization(user)
+	if err != nil {
+		return nil, err
+	}
+
+	if invitation != nil {
+		err = app.models.Invitations.Accept(invitation.ID)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				return nil, err
+			}
+
+			// accepted by a concurrent registration, undo this one
+			err = app.models.Users.Delete(user.ID)
+			if err != nil {
+				return nil, err
+			}
+			return nil, errNotInvited
+		}
+
+		err = app.grantInvitation(user, invitation)
+		if err != nil {
+			return nil, err
+		}
+
+		return user, nil
+	}
+
+	err = app.models.Roles.AddForUser(user.ID, app.config.defaultRole)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/mnabil1718/greenlight/internal/data"
+	"github.com/mnabil1718/greenlight/internal/validator"
+)
+
+type CreateOrganizationRequest struct {
+	Name string `json:"name"`
+}
+
+type OrganizationMemberRequest struct {
+	UserID int64  `json:"user_id"`
+	Role   string `json:"role"` // ignored when removing a member
+}
+
+func (app *application) listOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	memberships, err := app.models.Organizations.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"organizations": memberships}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createOrganizationHandler lets any activated user start an
+// organization, they become its first owner
+func (app *application) createOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	var createOrganizationRequest CreateOrganizationRequest
+	err := app.readJSON(w, r, &createOrganizationRequest)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	org := &data.Organization{
+		Name: createOrganizationRequest.Name,
+	}
+
+	v := validator.New()
+
+	if data.ValidateOrganization(v, org); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Organizations.Insert(org, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/organizations/%d/members", org.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"organization": org}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listOrganizationMembersHandler(w http.ResponseWriter, r *http.Request) {
+	membership, ok := app.readOrganizationFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	members, err := app.models.Organizations.GetMembers(membership.OrganizationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"members": members}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// setOrganizationMemberHandler adds a user to the organization or
+// changes their role. Admins manage members, only owners can hand
+// out the owner role or change the role of another owner.
+func (app *application) setOrganizationMemberHandler(w http.ResponseWriter, r *http.Request) {
+	membership, ok := app.readOrganizationFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if !membership.HasRole(data.OrganizationRoleAdmin) {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	var memberRequest OrganizationMemberRequest
+	err := app.readJSON(w, r, &memberRequest)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(memberRequest.UserID > 0, "user_id", "must be provided")
+	if data.ValidateOrganizationRole(v, memberRequest.Role); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Users.Get(memberRequest.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("user_id", "no user with this id")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	current, err := app.models.Organizations.GetMember(membership.OrganizationID, memberRequest.UserID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if memberRequest.Role == data.OrganizationRoleOwner || (current != nil && current.Role == data.OrganizationRoleOwner) {
+		if !membership.HasRole(data.OrganizationRoleOwner) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+	}
+
+	err = app.models.Organizations.SetMember(membership.OrganizationID, memberRequest.UserID, memberRequest.Role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrLastOwner):
+			v.AddError("role", "the last owner of an organization can't be demoted")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	members, err := app.models.Organizations.GetMembers(membership.OrganizationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"members": members}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// removeOrganizationMemberHandler takes a user out of the organization.
+// Members can always leave, removing someone else takes an admin, or
+// an owner when that someone is an owner too.
+func (app *application) removeOrganizationMemberHandler(w http.ResponseWriter, r *http.Request) {
+	membership, ok := app.readOrganizationFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var memberRequest OrganizationMemberRequest
+	err := app.readJSON(w, r, &memberRequest)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(memberRequest.UserID > 0, "user_id", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if memberRequest.UserID != membership.UserID {
+		current, err := app.models.Organizations.GetMember(membership.OrganizationID, memberRequest.UserID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		required := data.OrganizationRoleAdmin
+		if current.Role == data.OrganizationRoleOwner {
+			required = data.OrganizationRoleOwner
+		}
+
+		if !membership.HasRole(required) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+	}
+
+	err = app.models.Organizations.RemoveMember(membership.OrganizationID, memberRequest.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrLastOwner):
+			v.AddError("user_id", "the last owner of an organization can't be removed")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "member removed successfully."}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// joinDefaultOrganization makes a newly registered user a member of
+// the default organization, so the movie routes work for them right away
+func (app *application) joinDefaultOrganization(user *data.User) error {
+	if app.config.defaultOrganization == 0 {
+		return nil
+	}
+
+	return app.models.Organizations.SetMember(app.config.defaultOrganization, user.ID, data.OrganizationRoleMember)
+}
+
+// readOrganizationFromPath returns the current user's membership in
+// the organization named by the :id path parameter. Organizations the
+// user doesn't belong to are reported as not found.
+func (app *application) readOrganizationFromPath(w http.ResponseWriter, r *http.Request) (*data.Membership, bool) {
+	id, err := app.getIdFromRequestContext(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user := app.contextGetUser(r)
+
+	membership, err := app.models.Organizations.GetMember(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return membership, true
+}
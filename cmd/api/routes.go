@@ -3,8 +3,10 @@ package main
 import (
 	"expvar"
 	"net/http"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/mnabil1718/greenlight/internal/data"
 )
 
 func (app *application) routes() http.Handler {
@@ -16,16 +18,73 @@ func (app *application) routes() http.Handler {
 
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activation", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmUserEmailHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireFullUser(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireFullUser(app.preventImpersonation(app.preventAPIKey(app.updateCurrentUserHandler))))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireFullUser(app.preventImpersonation(app.preventAPIKey(app.deleteCurrentUserHandler))))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/export", app.requireFullUser(app.preventAPIKey(app.rateLimitUser(time.Hour, 3, app.createUserExportHandler))))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me/email", app.requireFullUser(app.preventImpersonation(app.preventAPIKey(app.updateCurrentUserEmailHandler))))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/mfa", app.requireFullUser(app.preventImpersonation(app.preventAPIKey(app.createMFAEnrollmentHandler))))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/mfa", app.requireFullUser(app.preventImpersonation(app.preventAPIKey(app.confirmMFAEnrollmentHandler))))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/mfa", app.requireFullUser(app.preventImpersonation(app.preventAPIKey(app.deleteMFAHandler))))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireAuthenticatedUser(app.preventAPIKey(app.listSessionsHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireAuthenticatedUser(app.preventImpersonation(app.preventAPIKey(app.deleteSessionHandler))))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys", app.requireActivatedUser(app.preventAPIKey(app.listAPIKeysHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-keys", app.requireActivatedUser(app.preventImpersonation(app.preventAPIKey(app.createAPIKeyHandler))))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-keys/:id", app.requireActivatedUser(app.preventImpersonation(app.preventAPIKey(app.deleteAPIKeyHandler))))
+
+	router.HandlerFunc(http.MethodGet, "/v1/exports/:token", app.showUserExportHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/oidc/authorize", app.oidcAuthorizeHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/oidc/callback", app.oidcCallbackHandler)
 
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireAuthenticatedUser(app.preventImpersonation(app.preventAPIKey(app.deleteAllAuthTokensHandler))))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/mfa", app.createMFAAuthTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link", app.createMagicLinkTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link/exchange", app.exchangeMagicLinkTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.requireOrganization(data.OrganizationRoleViewer, app.listMovieHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.requireMFA(app.requireOrganization(data.OrganizationRoleMember, app.createMovieHandler))))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.requireOrganization(data.OrganizationRoleViewer, app.showMovieHandler)))
+	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.requireMFA(app.requireOrganization(data.OrganizationRoleMember, app.updateMovieHandler))))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.requireMFA(app.requireOrganization(data.OrganizationRoleMember, app.deleteMovieHandler))))
+
+	router.HandlerFunc(http.MethodGet, "/v1/organizations", app.requireActivatedUser(app.listOrganizationsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/organizations", app.requireActivatedUser(app.preventImpersonation(app.preventAPIKey(app.createOrganizationHandler))))
+	router.HandlerFunc(http.MethodGet, "/v1/organizations/:id/members", app.requireActivatedUser(app.listOrganizationMembersHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/organizations/:id/members", app.requireActivatedUser(app.preventImpersonation(app.preventAPIKey(app.setOrganizationMemberHandler))))
+	router.HandlerFunc(http.MethodDelete, "/v1/organizations/:id/members", app.requireActivatedUser(app.preventImpersonation(app.preventAPIKey(app.removeOrganizationMemberHandler))))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("admin:users", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermission("admin:users", app.showUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/users/:id", app.requirePermission("admin:users", app.updateUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id", app.requirePermission("admin:users", app.deleteUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/password-reset", app.requirePermission("admin:users", app.forceUserPasswordResetHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/impersonate/:id", app.requirePermission("admin:impersonate", app.preventImpersonation(app.createImpersonationTokenHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/invitations", app.requirePermission("admin:users", app.createInvitationHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/permissions", app.requirePermission("permissions:admin", app.listPermissionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/permissions", app.requirePermission("permissions:admin", app.listUserPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission("permissions:admin", app.addUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions", app.requirePermission("permissions:admin", app.removeUserPermissionsHandler))
 
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMovieHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/roles", app.requirePermission("permissions:admin", app.listRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/roles", app.requirePermission("permissions:admin", app.createRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/roles/:id", app.requirePermission("permissions:admin", app.showRoleHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/roles/:id", app.requirePermission("permissions:admin", app.updateRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/roles/:id", app.requirePermission("permissions:admin", app.deleteRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/roles", app.requirePermission("permissions:admin", app.listUserRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/roles", app.requirePermission("permissions:admin", app.addUserRolesHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles", app.requirePermission("permissions:admin", app.removeUserRolesHandler))
 
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
 
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(app.audit(router))))))
 }
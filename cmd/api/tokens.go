@@ -1,17 +1,43 @@
 package main
 
 import (
+	"crypto/sha256"
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/mnabil1718/greenlight/internal/data"
+	"github.com/mnabil1718/greenlight/internal/jwt"
 	"github.com/mnabil1718/greenlight/internal/validator"
+	"github.com/tomasen/realip"
 )
 
 type CreateAuthTokenRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	Label    string `json:"label"` // optional, helps telling sessions apart
+}
+
+type CreatePasswordResetTokenRequest struct {
+	Email string `json:"email"`
+}
+
+type CreateActivationTokenRequest struct {
+	Email string `json:"email"`
+}
+
+type RefreshAuthTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type CreateMagicLinkTokenRequest struct {
+	Email string `json:"email"`
+}
+
+type ExchangeMagicLinkTokenRequest struct {
+	TokenPlainText string `json:"token"`
+	Label          string `json:"label"`
 }
 
 func (app *application) createAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -27,42 +53,709 @@ func (app *application) createAuthTokenHandler(w http.ResponseWriter, r *http.Re
 	v := validator.New()
 
 	data.ValidateEmail(v, createAuthTokenRequest.Email)
-	data.ValidatePasswordPlaintext(v, createAuthTokenRequest.Password)
+	data.ValidatePasswordLogin(v, createAuthTokenRequest.Password)
+	data.ValidateTokenLabel(v, createAuthTokenRequest.Label)
 
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	ip := realip.FromRequest(r)
+
+	ipAttempt, err := app.models.LoginAttempts.Get(data.LoginScopeIP, ip)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if ipAttempt.Locked() {
+		app.loginLockedResponse(w, r, ipAttempt.RetryAfter())
+		return
+	}
+
 	user, err := app.models.Users.GetByEmail(createAuthTokenRequest.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.invalidCredentialsResponse(w, r)
+			app.failedLoginResponse(w, r, ip, nil)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
+	accountAttempt, err := app.models.LoginAttempts.Get(data.LoginScopeAccount, strconv.FormatInt(user.ID, 10))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if accountAttempt.Locked() {
+		app.loginLockedResponse(w, r, accountAttempt.RetryAfter())
+		return
+	}
+
 	ok, err := user.Password.Matches(createAuthTokenRequest.Password)
 	if !ok {
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 		} else {
-			app.invalidCredentialsResponse(w, r)
+			app.failedLoginResponse(w, r, ip, user)
+		}
+		return
+	}
+
+	err = app.resetFailedLogins(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// upgrade hashes made with an older algorithm or cost while
+	// the plaintext is at hand, a failure here shouldn't block login
+	if user.Password.NeedsRehash() {
+		err = app.rehashPassword(user, createAuthTokenRequest.Password)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"user_id": strconv.FormatInt(user.ID, 10)})
+		}
+	}
+
+	app.issueAuthenticationToken(w, r, user, createAuthTokenRequest.Label)
+}
+
+func (app *application) rehashPassword(user *data.User, plaintext string) error {
+	err := user.Password.Set(plaintext)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil && !errors.Is(err, data.ErrEditConflict) {
+		return err
+	}
+
+	// on an edit conflict the user changed meanwhile,
+	// the next login will try again
+	return nil
+}
+
+// issueAuthenticationToken finishes a successful login. Users with
+// two-factor authentication enabled get a short-lived mfa-pending
+// token instead, to be exchanged through POST /v1/tokens/mfa.
+func (app *application) issueAuthenticationToken(w http.ResponseWriter, r *http.Request, user *data.User, label string) {
+	mfa, err := app.models.MFA.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if mfa != nil && mfa.Enabled {
+		token, err := app.models.Tokens.New(user.ID, 5*time.Minute, data.ScopeMFAPending)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusAccepted, envelope{"mfa_required": true, "mfa_token": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	app.issueSessionToken(w, r, user, label, 0)
+}
+
+// issueSessionToken responds with a new authentication and refresh
+// token pair. familyID is 0 for a new login, or the family of the
+// refresh token being rotated.
+func (app *application) issueSessionToken(w http.ResponseWriter, r *http.Request, user *data.User, label string, familyID int64) {
+	if app.config.tokens.format == "signed" {
+		app.issueSignedToken(w, r, user, label, familyID)
+		return
+	}
+
+	token, refreshToken, err := app.models.Tokens.NewSession(user.ID, app.config.tokens.ttl, app.config.tokens.refreshTTL, r.UserAgent(), realip.FromRequest(r), label, familyID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refreshToken}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// issueSignedToken is issueSessionToken for the signed token format.
+// The permissions are baked into the token, so grant changes only
+// apply to it once it expires, which is why it is short-lived.
+func (app *application) issueSignedToken(w http.ResponseWriter, r *http.Request, user *data.User, label string, familyID int64) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	orgID, err := app.tokenOrganization(r, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	jti, err := jwt.NewID()
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	refreshToken, err := app.models.Tokens.NewRefresh(user.ID, app.config.tokens.refreshTTL, r.UserAgent(), realip.FromRequest(r), label, familyID, jti)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.tokens.signedTTL)
+
+	token, err := app.signer.Sign(jwt.Claims{
+		Subject:     strconv.FormatInt(user.ID, 10),
+		ExpiresAt:   expiry.Unix(),
+		IssuedAt:    now.Unix(),
+		ID:          jti,
+		Permissions: permissions,
+		Activated:   user.Activated,
+		Family:      *refreshToken.FamilyID,
+		Org:         orgID,
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"authentication_token": envelope{"token": token, "expiry_time": expiry},
+		"refresh_token":        refreshToken,
 	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// tokenOrganization picks the organization a signed token acts in by
+// default: the one named by X-Organization-ID when the user belongs to
+// it, otherwise their only organization. Zero leaves it to the header.
+func (app *application) tokenOrganization(r *http.Request, userID int64) (int64, error) {
+	if header := r.Header.Get("X-Organization-ID"); header != "" {
+		orgID, err := strconv.ParseInt(header, 10, 64)
+		if err == nil {
+			_, err = app.models.Organizations.GetMember(orgID, userID)
+			switch {
+			case err == nil:
+				return orgID, nil
+			case !errors.Is(err, data.ErrRecordNotFound):
+				return 0, err
+			}
+		}
+	}
+
+	memberships, err := app.models.Organizations.GetAllForUser(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(memberships) == 1 {
+		return memberships[0].OrganizationID, nil
+	}
+
+	return 0, nil
+}
+
+// revokeSessions logs the user out everywhere, signed access tokens
+// included, e.g. after a password reset or when the account is deactivated
+func (app *application) revokeSessions(userID int64) error {
+	jtis, err := app.models.Tokens.DeleteSessionsForUser(userID)
+	if err != nil {
+		return err
+	}
+
+	return app.denyAccessTokens(jtis)
+}
+
+// revokeFamily deletes a session's tokens and denies the signed
+// access tokens issued with them, which would otherwise stay valid
+func (app *application) revokeFamily(familyID int64) error {
+	jtis, err := app.models.Tokens.DeleteFamily(familyID)
+	if err != nil {
+		return err
+	}
+
+	return app.denyAccessTokens(jtis)
+}
+
+// denyAccessTokens adds signed access tokens to the denylist. Their
+// expiry isn't stored, but none outlives signed-token-ttl from now.
+func (app *application) denyAccessTokens(jtis []string) error {
+	expiry := time.Now().Add(app.config.tokens.signedTTL)
+
+	for _, jti := range jtis {
+		err := app.models.Denylist.Insert(jti, expiry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sessionScope is the scope of the token sessions are listed by,
+// the refresh token when access tokens are signed and not stored
+func (app *application) sessionScope() string {
+	if app.config.tokens.format == "signed" {
+		return data.ScopeRefresh
+	}
+	return data.ScopeAuthentication
+}
+
+// refreshDenylist keeps the in-memory copy of revoked signed tokens
+// in step with revocations made by other instances of the API
+func (app *application) refreshDenylist() {
+	for {
+		err := app.models.Denylist.Refresh()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+
+		time.Sleep(app.config.tokens.denylistRefresh)
+	}
+}
+
+// failedLoginResponse counts the failure against the client IP and,
+// when the email matched an account, against that account too. The
+// response tells the client when a lockout has just kicked in.
+func (app *application) failedLoginResponse(w http.ResponseWriter, r *http.Request, ip string, user *data.User) {
+	cfg := app.config.login
+
+	attempt, err := app.models.LoginAttempts.RegisterFailure(data.LoginScopeIP, ip, cfg.maxIPFailures, cfg.lockoutDuration, cfg.maxLockoutDuration)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user != nil {
+		accountAttempt, err := app.models.LoginAttempts.RegisterFailure(data.LoginScopeAccount, strconv.FormatInt(user.ID, 10), cfg.maxFailures, cfg.lockoutDuration, cfg.maxLockoutDuration)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if accountAttempt.JustLocked {
+			app.background(func() {
+				err := app.mailer.Send(user.Email, "account_locked.tmpl", map[string]interface{}{
+					"ip":          ip,
+					"lockedUntil": accountAttempt.LockedUntil.Format(time.RFC1123),
+				})
+				if err != nil {
+					app.logger.PrintError(err, nil)
+				}
+			})
+		}
+
+		if accountAttempt.RetryAfter() > attempt.RetryAfter() {
+			attempt = accountAttempt
+		}
+	}
+
+	if attempt.Locked() {
+		app.loginLockedResponse(w, r, attempt.RetryAfter())
+		return
+	}
+
+	app.invalidCredentialsResponse(w, r)
+}
+
+// resetFailedLogins clears the account's failures once its owner gets
+// in. Failures from the IP are left to expire, a single valid login
+// would otherwise reset an attacker guessing at many accounts.
+func (app *application) resetFailedLogins(user *data.User) error {
+	return app.models.LoginAttempts.Reset(data.LoginScopeAccount, strconv.FormatInt(user.ID, 10))
+}
+
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var createPasswordResetTokenRequest CreatePasswordResetTokenRequest
+
+	err := app.readJSON(w, r, &createPasswordResetTokenRequest)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, createPasswordResetTokenRequest.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// the response is the same whether or not the email exists,
+	// so this endpoint can't be used to enumerate accounts
+	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+
+	user, err := app.models.Users.GetByEmail(createPasswordResetTokenRequest.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Activated {
+		token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(func() {
+			err := app.mailer.Send(user.Email, "token_password_reset.tmpl", map[string]interface{}{
+				"passwordResetToken": token.Plaintext,
+			})
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var createActivationTokenRequest CreateActivationTokenRequest
+
+	err := app.readJSON(w, r, &createActivationTokenRequest)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, createActivationTokenRequest.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// unknown, already activated and deactivated accounts get the
+	// same response, only the email itself is skipped for them
+	env := envelope{"message": "an email will be sent to you containing activation instructions"}
+
+	user, err := app.models.Users.GetByEmail(createActivationTokenRequest.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !user.Activated && user.DeactivatedAt == nil {
+		// only the latest activation token should be usable
+		err = app.models.Tokens.DeleteForAllUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(func() {
+			err := app.mailer.Send(user.Email, "token_activation.tmpl", map[string]interface{}{
+				"activationToken": token.Plaintext,
+			})
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if claims := app.contextGetClaims(r); claims != nil {
+		app.revokeSignedToken(w, r, claims, "authentication token revoked successfully.")
+		return
+	}
+
+	hash := sha256.Sum256([]byte(app.contextGetToken(r)))
+
+	// logging out ends the whole session, so the
+	// refresh token can't bring it back
+	err := app.models.Tokens.DeleteSessionByHash(hash[:])
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "authentication token revoked successfully."}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeSignedToken denylists a signed token until it expires
+// and ends the session its refresh token belongs to
+func (app *application) revokeSignedToken(w http.ResponseWriter, r *http.Request, claims *jwt.Claims, message string) {
+	err := app.models.Denylist.Insert(claims.ID, time.Unix(claims.ExpiresAt, 0))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if claims.Family != 0 {
+		err = app.revokeFamily(claims.Family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAllAuthTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.revokeSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// the current token may have been issued before its id was
+	// recorded with the refresh token, so it is denied separately
+	if claims := app.contextGetClaims(r); claims != nil {
+		err = app.models.Denylist.Insert(claims.ID, time.Unix(claims.ExpiresAt, 0))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all authentication tokens revoked successfully."}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// refreshAuthTokenHandler rotates a refresh token, handing out a new
+// authentication and refresh token pair in the same family. A rotated
+// token presented again means two parties hold it, so the whole family
+// is revoked and the legitimate client has to log in again.
+func (app *application) refreshAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var refreshAuthTokenRequest RefreshAuthTokenRequest
+
+	err := app.readJSON(w, r, &refreshAuthTokenRequest)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, refreshAuthTokenRequest.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.models.Tokens.UseRefresh(refreshAuthTokenRequest.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("refresh_token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrTokenReused):
+			if token.FamilyID != nil {
+				err = app.revokeFamily(*token.FamilyID)
+				if err != nil {
+					app.serverErrorResponse(w, r, err)
+					return
+				}
+			}
+
+			app.logger.PrintInfo("refresh token reuse detected, session revoked", map[string]string{
+				"user_id": strconv.FormatInt(token.UserID, 10),
+				"ip":      realip.FromRequest(r),
+			})
+
+			v.AddError("refresh_token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(token.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("refresh_token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the access token issued along with the used refresh token is
+	// replaced, opaque ones are deleted by the rotation itself
+	if token.AccessJTI != "" {
+		err = app.denyAccessTokens([]string{token.AccessJTI})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	var familyID int64
+	if token.FamilyID != nil {
+		familyID = *token.FamilyID
+	}
+
+	app.issueSessionToken(w, r, user, token.Label, familyID)
+}
+
+func (app *application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var createMagicLinkTokenRequest CreateMagicLinkTokenRequest
+
+	err := app.readJSON(w, r, &createMagicLinkTokenRequest)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, createMagicLinkTokenRequest.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "an email will be sent to you containing a login link"}
+
+	user, err := app.models.Users.GetByEmail(createMagicLinkTokenRequest.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Activated {
+		token, err := app.models.Tokens.New(user.ID, 15*time.Minute, data.ScopeMagicLink)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(func() {
+			err := app.mailer.Send(user.Email, "token_magic_link.tmpl", map[string]interface{}{
+				"magicLinkToken": token.Plaintext,
+			})
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) exchangeMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var exchangeMagicLinkTokenRequest ExchangeMagicLinkTokenRequest
+
+	err := app.readJSON(w, r, &exchangeMagicLinkTokenRequest)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, exchangeMagicLinkTokenRequest.TokenPlainText)
+	data.ValidateTokenLabel(v, exchangeMagicLinkTokenRequest.Label)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeMagicLink, exchangeMagicLinkTokenRequest.TokenPlainText)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired magic link token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the account may have been deactivated since the link was sent
+	if !user.Activated {
+		app.inactivateAccountResponse(w, r)
+		return
+	}
+
+	// single use, any other outstanding link is dropped as well
+	err = app.models.Tokens.DeleteForAllUser(data.ScopeMagicLink, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.issueAuthenticationToken(w, r, user, exchangeMagicLinkTokenRequest.Label)
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/mnabil1718/greenlight/internal/data"
@@ -10,15 +11,40 @@ import (
 )
 
 type CreateUserRequest struct {
-	Name     string `json:"name,omitempty"`
-	Email    string `json:"email,omitempty"`
-	Password string `json:"password,omitempty"`
+	Name           string `json:"name,omitempty"`
+	Email          string `json:"email,omitempty"`
+	Password       string `json:"password,omitempty"`
+	InvitationCode string `json:"invitation_code,omitempty"` // required when registration is invite-only
 }
 
 type ActivateUserRequest struct {
 	TokenPlainText string `json:"token"`
 }
 
+type UpdateCurrentUserRequest struct {
+	Name            *string `json:"name"`
+	Password        *string `json:"password"`
+	CurrentPassword string  `json:"current_password"`
+}
+
+type UpdateCurrentUserEmailRequest struct {
+	Email           string `json:"email"`
+	CurrentPassword string `json:"current_password"`
+}
+
+type ConfirmUserEmailRequest struct {
+	TokenPlainText string `json:"token"`
+}
+
+type DeleteCurrentUserRequest struct {
+	CurrentPassword string `json:"current_password"`
+}
+
+type UpdateUserPasswordRequest struct {
+	Password       string `json:"password"`
+	TokenPlainText string `json:"token"`
+}
+
 func (app *application) registerUserHandler(writer http.ResponseWriter, request *http.Request) {
 	var createUserRequest CreateUserRequest
 	err := app.readJSON(writer, request, &createUserRequest)
@@ -27,10 +53,23 @@ func (app *application) registerUserHandler(writer http.ResponseWriter, request
 		return
 	}
 
+	var invitation *data.Invitation
+	if createUserRequest.InvitationCode != "" || app.config.inviteOnly {
+		var ok bool
+		invitation, ok = app.readInvitation(writer, request, createUserRequest.InvitationCode)
+		if !ok {
+			return
+		}
+
+		if createUserRequest.Email == "" {
+			createUserRequest.Email = invitation.Email
+		}
+	}
+
 	user := &data.User{
 		Name:      createUserRequest.Name,
 		Email:     createUserRequest.Email,
-		Activated: false,
+		Activated: invitation != nil, // the invitation email proves the address
 	}
 	err = user.Password.Set(createUserRequest.Password)
 	if err != nil {
@@ -39,11 +78,26 @@ func (app *application) registerUserHandler(writer http.ResponseWriter, request
 	}
 
 	v := validator.New()
+	if invitation != nil {
+		v.Check(strings.EqualFold(user.Email, invitation.Email), "email", "must match the email address the invitation was sent to")
+	}
+
 	if data.ValidateUser(v, user); !v.Valid() {
 		app.failedValidationResponse(writer, request, v.Errors)
 		return
 	}
 
+	err = data.ValidatePasswordPolicy(v, createUserRequest.Password, user)
+	if err != nil {
+		app.serverErrorResponse(writer, request, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(writer, request, v.Errors)
+		return
+	}
+
 	err = app.models.Users.Insert(user)
 	if err != nil {
 		switch {
@@ -57,7 +111,18 @@ func (app *application) registerUserHandler(writer http.ResponseWriter, request
 		return
 	}
 
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
+	err = app.joinDefaultOrganization(user)
+	if err != nil {
+		app.serverErrorResponse(writer, request, err)
+		return
+	}
+
+	if invitation != nil {
+		app.acceptInvitation(writer, request, user, invitation)
+		return
+	}
+
+	err = app.models.Roles.AddForUser(user.ID, app.config.defaultRole)
 	if err != nil {
 		app.serverErrorResponse(writer, request, err)
 		return
@@ -112,6 +177,13 @@ func (app *application) activateUserHandler(writer http.ResponseWriter, request
 		return
 	}
 
+	// an admin deactivated the account, only an admin can undo that
+	if user.DeactivatedAt != nil {
+		v.AddError("token", "invalid or expired activation token")
+		app.failedValidationResponse(writer, request, v.Errors)
+		return
+	}
+
 	user.Activated = true
 
 	err = app.models.Users.Update(user)
@@ -136,3 +208,385 @@ func (app *application) activateUserHandler(writer http.ResponseWriter, request
 		app.serverErrorResponse(writer, request, err)
 	}
 }
+
+func (app *application) updateUserPasswordHandler(writer http.ResponseWriter, request *http.Request) {
+	var updateUserPasswordRequest UpdateUserPasswordRequest
+	err := app.readJSON(writer, request, &updateUserPasswordRequest)
+	if err != nil {
+		app.badRequestResponse(writer, request, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlaintext(v, updateUserPasswordRequest.Password)
+	data.ValidateTokenPlaintext(v, updateUserPasswordRequest.TokenPlainText)
+
+	if !v.Valid() {
+		app.failedValidationResponse(writer, request, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, updateUserPasswordRequest.TokenPlainText)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(writer, request, v.Errors)
+		default:
+			app.serverErrorResponse(writer, request, err)
+		}
+		return
+	}
+
+	err = data.ValidatePasswordPolicy(v, updateUserPasswordRequest.Password, user)
+	if err != nil {
+		app.serverErrorResponse(writer, request, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(writer, request, v.Errors)
+		return
+	}
+
+	err = user.Password.Set(updateUserPasswordRequest.Password)
+	if err != nil {
+		app.serverErrorResponse(writer, request, err)
+		return
+	}
+
+	// Update bumps the version, so any concurrent
+	// edit made with the old record will conflict
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(writer, request)
+		default:
+			app.serverErrorResponse(writer, request, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteForAllUser(data.ScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(writer, request, err)
+		return
+	}
+
+	// anyone holding a session opened with the old password is logged out
+	err = app.revokeSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(writer, request, err)
+		return
+	}
+
+	err = app.writeJSON(writer, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil)
+	if err != nil {
+		app.serverErrorResponse(writer, request, err)
+	}
+}
+
+func (app *application) showCurrentUserHandler(writer http.ResponseWriter, request *http.Request) {
+	user := app.contextGetUser(request)
+	permissions := app.contextGetPermissions(request)
+
+	err := app.writeJSON(writer, http.StatusOK, envelope{"user": user, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(writer, request, err)
+	}
+}
+
+func (app *application) updateCurrentUserHandler(writer http.ResponseWriter, request *http.Request) {
+	var updateCurrentUserRequest UpdateCurrentUserRequest
+	err := app.readJSON(writer, request, &updateCurrentUserRequest)
+	if err != nil {
+		app.badRequestResponse(writer, request, err)
+		return
+	}
+
+	user := app.contextGetUser(request)
+
+	v := validator.New()
+	v.Check(updateCurrentUserRequest.CurrentPassword != "", "current_password", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(writer, request, v.Errors)
+		return
+	}
+
+	ok, err := user.Password.Matches(updateCurrentUserRequest.CurrentPassword)
+	if !ok {
+		if err != nil {
+			app.serverErrorResponse(writer, request, err)
+		} else {
+			v.AddError("current_password", "does not match your current password")
+			app.failedValidationResponse(writer, request, v.Errors)
+		}
+		return
+	}
+
+	if updateCurrentUserRequest.Name != nil {
+		user.Name = *updateCurrentUserRequest.Name
+	}
+	if updateCurrentUserRequest.Password != nil {
+		err = user.Password.Set(*updateCurrentUserRequest.Password)
+		if err != nil {
+			app.serverErrorResponse(writer, request, err)
+			return
+		}
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(writer, request, v.Errors)
+		return
+	}
+
+	if updateCurrentUserRequest.Password != nil {
+		err = data.ValidatePasswordPolicy(v, *updateCurrentUserRequest.Password, user)
+		if err != nil {
+			app.serverErrorResponse(writer, request, err)
+			return
+		}
+
+		if !v.Valid() {
+			app.failedValidationResponse(writer, request, v.Errors)
+			return
+		}
+	}
+
+	// the version read by authenticate is sent along, so a concurrent
+	// change to the same account results in an edit conflict
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(writer, request)
+		default:
+			app.serverErrorResponse(writer, request, err)
+		}
+		return
+	}
+
+	if updateCurrentUserRequest.Password != nil {
+		// an outstanding reset token would let someone undo the change
+		err = app.models.Tokens.DeleteForAllUser(data.ScopePasswordReset, user.ID)
+		if err != nil {
+			app.serverErrorResponse(writer, request, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(writer, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(writer, request, err)
+	}
+}
+
+func (app *application) updateCurrentUserEmailHandler(writer http.ResponseWriter, request *http.Request) {
+	var updateCurrentUserEmailRequest UpdateCurrentUserEmailRequest
+	err := app.readJSON(writer, request, &updateCurrentUserEmailRequest)
+	if err != nil {
+		app.badRequestResponse(writer, request, err)
+		return
+	}
+
+	user := app.contextGetUser(request)
+
+	v := validator.New()
+	data.ValidateEmail(v, updateCurrentUserEmailRequest.Email)
+	v.Check(updateCurrentUserEmailRequest.CurrentPassword != "", "current_password", "must be provided")
+	v.Check(updateCurrentUserEmailRequest.Email != user.Email, "email", "must be different from your current email")
+	if !v.Valid() {
+		app.failedValidationResponse(writer, request, v.Errors)
+		return
+	}
+
+	ok, err := user.Password.Matches(updateCurrentUserEmailRequest.CurrentPassword)
+	if !ok {
+		if err != nil {
+			app.serverErrorResponse(writer, request, err)
+		} else {
+			v.AddError("current_password", "does not match your current password")
+			app.failedValidationResponse(writer, request, v.Errors)
+		}
+		return
+	}
+
+	_, err = app.models.Users.GetByEmail(updateCurrentUserEmailRequest.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "email already exists")
+		app.failedValidationResponse(writer, request, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(writer, request, err)
+		return
+	}
+
+	user.PendingEmail = &updateCurrentUserEmailRequest.Email
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(writer, request)
+		default:
+			app.serverErrorResponse(writer, request, err)
+		}
+		return
+	}
+
+	// only the token for the latest requested address stays valid
+	err = app.models.Tokens.DeleteForAllUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(writer, request, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeEmailChange)
+	if err != nil {
+		app.serverErrorResponse(writer, request, err)
+		return
+	}
+
+	oldEmail, newEmail := user.Email, *user.PendingEmail
+
+	app.background(func() {
+		err := app.mailer.Send(newEmail, "email_change_confirm.tmpl", map[string]interface{}{
+			"emailChangeToken": token.Plaintext,
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+
+		err = app.mailer.Send(oldEmail, "email_change_notice.tmpl", map[string]interface{}{
+			"newEmail": newEmail,
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	err = app.writeJSON(writer, http.StatusAccepted, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(writer, request, err)
+	}
+}
+
+func (app *application) confirmUserEmailHandler(writer http.ResponseWriter, request *http.Request) {
+	var confirmUserEmailRequest ConfirmUserEmailRequest
+	err := app.readJSON(writer, request, &confirmUserEmailRequest)
+	if err != nil {
+		app.badRequestResponse(writer, request, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, confirmUserEmailRequest.TokenPlainText); !v.Valid() {
+		app.failedValidationResponse(writer, request, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeEmailChange, confirmUserEmailRequest.TokenPlainText)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(writer, request, v.Errors)
+		default:
+			app.serverErrorResponse(writer, request, err)
+		}
+		return
+	}
+
+	if user.PendingEmail == nil {
+		v.AddError("token", "invalid or expired email change token")
+		app.failedValidationResponse(writer, request, v.Errors)
+		return
+	}
+
+	user.Email = *user.PendingEmail
+	user.PendingEmail = nil
+
+	// the address may have been registered by someone
+	// else since the change was requested
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "email already exists")
+			app.failedValidationResponse(writer, request, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(writer, request)
+		default:
+			app.serverErrorResponse(writer, request, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteForAllUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(writer, request, err)
+		return
+	}
+
+	err = app.writeJSON(writer, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(writer, request, err)
+	}
+}
+
+func (app *application) deleteCurrentUserHandler(writer http.ResponseWriter, request *http.Request) {
+	var deleteCurrentUserRequest DeleteCurrentUserRequest
+	err := app.readJSON(writer, request, &deleteCurrentUserRequest)
+	if err != nil {
+		app.badRequestResponse(writer, request, err)
+		return
+	}
+
+	user := app.contextGetUser(request)
+
+	v := validator.New()
+	v.Check(deleteCurrentUserRequest.CurrentPassword != "", "current_password", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(writer, request, v.Errors)
+		return
+	}
+
+	ok, err := user.Password.Matches(deleteCurrentUserRequest.CurrentPassword)
+	if !ok {
+		if err != nil {
+			app.serverErrorResponse(writer, request, err)
+		} else {
+			v.AddError("current_password", "does not match your current password")
+			app.failedValidationResponse(writer, request, v.Errors)
+		}
+		return
+	}
+
+	// deleting the user cascades to the tokens, the signed
+	// access tokens issued with them have to be denied first
+	err = app.revokeSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(writer, request, err)
+		return
+	}
+
+	err = app.models.Users.Delete(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(writer, request)
+		default:
+			app.serverErrorResponse(writer, request, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(writer, http.StatusOK, envelope{"message": "user account deleted successfully."}, nil)
+	if err != nil {
+		app.serverErrorResponse(writer, request, err)
+	}
+}
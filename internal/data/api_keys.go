@@ -0,0 +1,190 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/mnabil1718/greenlight/internal/validator"
+)
+
+// APIKeyPrefix starts every API key, so keys are easy to spot in
+// config files and secret scanners, and tell apart from tokens
+const APIKeyPrefix = "glk_"
+
+// APIKey is a long-lived credential for machine clients. It can only
+// use the listed permissions, and only while its owner still holds them.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	Plaintext   string      `json:"key,omitempty"` // only set right after creation
+	Hash        []byte      `json:"-"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Prefix      string      `json:"prefix"`
+	Permissions Permissions `json:"permissions"`
+	ExpiryTime  *time.Time  `json:"expiry_time,omitempty"` // nil for keys that never expire
+	CreatedAt   time.Time   `json:"created_at"`
+	LastUsedAt  *time.Time  `json:"last_used_at,omitempty"`
+}
+
+func IsAPIKey(value string) bool {
+	return strings.HasPrefix(value, APIKeyPrefix)
+}
+
+// ValidateAPIKey checks the key against the permissions table and
+// against granted, the permissions the owner holds right now
+func ValidateAPIKey(v *validator.Validator, key *APIKey, known Permissions, granted Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range key.Permissions {
+		validatePermissionCode(v, "permissions", code, known)
+		v.Check(granted.Include(code), "permissions", "must only contain permissions you hold")
+	}
+	if key.ExpiryTime != nil {
+		v.Check(key.ExpiryTime.After(time.Now()), "expiry_time", "must be in the future")
+	}
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// New generates the key's secret and stores it, Plaintext
+// is filled in so it can be shown to the user once
+func (model APIKeyModel) New(key *APIKey) error {
+	secret, hash, err := generateSecret(20)
+	if err != nil {
+		return err
+	}
+
+	key.Plaintext = APIKeyPrefix + secret
+	key.Hash = hash
+	key.Prefix = key.Plaintext[:len(APIKeyPrefix)+6]
+
+	SQL := `INSERT INTO api_keys (user_id, name, prefix, hash, permissions, expiry_time)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id, created_at`
+
+	args := []interface{}{key.UserID, key.Name, key.Prefix, key.Hash, []string(key.Permissions), key.ExpiryTime}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return model.DB.QueryRowContext(ctx, SQL, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+func (model APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	SQL := `SELECT id, user_id, name, prefix, permissions, expiry_time, created_at, last_used_at
+			FROM api_keys
+			WHERE user_id=$1
+			ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key := &APIKey{}
+
+		m := pgtype.NewMap()
+		var permissions []string
+
+		err = rows.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, m.SQLScanner(&permissions), &key.ExpiryTime, &key.CreatedAt, &key.LastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		key.Permissions = permissions
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetForKey looks up an unexpired key by its plaintext, together with its owner
+func (model APIKeyModel) GetForKey(plaintext string) (*APIKey, *User, error) {
+	SQL := `SELECT k.id, k.user_id, k.name, k.prefix, k.permissions, k.expiry_time, k.created_at, k.last_used_at,
+			u.id, u.name, u.email, u.pending_email, u.password, u.activated, u.deactivated_at, u.version, u.created_at
+			FROM api_keys k
+			INNER JOIN users u ON u.id=k.user_id
+			WHERE k.hash=$1 AND (k.expiry_time IS NULL OR k.expiry_time > NOW())`
+
+	hash := sha256.Sum256([]byte(strings.TrimPrefix(plaintext, APIKeyPrefix)))
+
+	key := &APIKey{}
+	user := &User{}
+
+	m := pgtype.NewMap()
+	var permissions []string
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := model.DB.QueryRowContext(ctx, SQL, hash[:]).Scan(
+		&key.ID, &key.UserID, &key.Name, &key.Prefix, m.SQLScanner(&permissions), &key.ExpiryTime, &key.CreatedAt, &key.LastUsedAt,
+		&user.ID, &user.Name, &user.Email, &user.PendingEmail, &user.Password.hash, &user.Activated, &user.DeactivatedAt, &user.Version, &user.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	key.Permissions = permissions
+	return key, user, nil
+}
+
+// Touch records that the key has just been used, at most once a minute
+func (model APIKeyModel) Touch(id int64) error {
+	SQL := `UPDATE api_keys SET last_used_at = NOW()
+			WHERE id=$1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := model.DB.ExecContext(ctx, SQL, id)
+	return err
+}
+
+func (model APIKeyModel) Delete(id int64, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	SQL := `DELETE FROM api_keys WHERE id=$1 AND user_id=$2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := model.DB.ExecContext(ctx, SQL, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// AuditEntry records a request made by ActorID on behalf of
+// UserID, e.g. while an admin impersonates a user
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	ActorID   int64     `json:"actor_id"`
+	UserID    int64     `json:"user_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AuditModel struct {
+	DB *sql.DB
+}
+
+func (model AuditModel) Insert(entry *AuditEntry) error {
+	SQL := `INSERT INTO audit_log (actor_id, user_id, method, path, status, ip)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id, created_at`
+
+	args := []interface{}{entry.ActorID, entry.UserID, entry.Method, entry.Path, entry.Status, entry.IP}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return model.DB.QueryRowContext(ctx, SQL, args...).Scan(&entry.ID, &entry.CreatedAt)
+}
+
+// GetAllForUser returns the entries about the user, both the requests
+// made on their behalf and the ones they made as someone else
+func (model AuditModel) GetAllForUser(userID int64) ([]*AuditEntry, error) {
+	SQL := `SELECT id, actor_id, user_id, method, path, status, ip, created_at
+			FROM audit_log
+			WHERE user_id=$1 OR actor_id=$1
+			ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		entry := &AuditEntry{}
+
+		err = rows.Scan(&entry.ID, &entry.ActorID, &entry.UserID, &entry.Method, &entry.Path, &entry.Status, &entry.IP, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
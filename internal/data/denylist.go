@@ -0,0 +1,119 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// denylistCache mirrors the unexpired rows of token_denylist, so signed
+// tokens can be checked without a database round-trip. Revocations made
+// by this instance show up immediately, those made by other instances
+// once the cache is refreshed.
+type denylistCache struct {
+	mu  sync.RWMutex
+	ids map[string]time.Time
+}
+
+func newDenylistCache() *denylistCache {
+	return &denylistCache{ids: make(map[string]time.Time)}
+}
+
+type DenylistModel struct {
+	DB    *sql.DB
+	cache *denylistCache
+}
+
+// Insert revokes a signed token until expiry, when it would stop being accepted anyway
+func (model DenylistModel) Insert(jti string, expiry time.Time) error {
+	SQL := `INSERT INTO token_denylist (jti, expiry_time)
+			VALUES ($1, $2)
+			ON CONFLICT (jti) DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := model.DB.ExecContext(ctx, SQL, jti, expiry)
+	if err != nil {
+		return err
+	}
+
+	if model.cache != nil {
+		model.cache.mu.Lock()
+		model.cache.ids[jti] = expiry
+		model.cache.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Contains only looks at the in-memory copy
+func (model DenylistModel) Contains(jti string) bool {
+	if model.cache == nil {
+		return false
+	}
+
+	model.cache.mu.RLock()
+	defer model.cache.mu.RUnlock()
+
+	_, ok := model.cache.ids[jti]
+	return ok
+}
+
+// Refresh drops expired entries and merges the table into the in-memory copy
+func (model DenylistModel) Refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := model.DB.ExecContext(ctx, `DELETE FROM token_denylist WHERE expiry_time <= NOW()`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := model.DB.QueryContext(ctx, `SELECT jti, expiry_time FROM token_denylist`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	ids := make(map[string]time.Time)
+	for rows.Next() {
+		var jti string
+		var expiry time.Time
+
+		err = rows.Scan(&jti, &expiry)
+		if err != nil {
+			return err
+		}
+
+		ids[jti] = expiry
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if model.cache != nil {
+		model.cache.merge(ids, time.Now())
+	}
+
+	return nil
+}
+
+// merge adds ids to the cache and evicts expired entries. Entries are
+// never dropped just for missing from ids, Insert may have added them
+// after the snapshot was read.
+func (c *denylistCache) merge(ids map[string]time.Time, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for jti, expiry := range ids {
+		c.ids[jti] = expiry
+	}
+
+	for jti, expiry := range c.ids {
+		if !expiry.After(now) {
+			delete(c.ids, jti)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDenylistCacheMerge(t *testing.T) {
+	now := time.Now()
+
+	cache := newDenylistCache()
+	cache.ids["local"] = now.Add(time.Minute)    // inserted after the snapshot was read
+	cache.ids["expired"] = now.Add(-time.Minute) // past its expiry
+
+	cache.merge(map[string]time.Time{
+		"remote":         now.Add(time.Minute),
+		"remote-expired": now,
+	}, now)
+
+	tests := []struct {
+		jti  string
+		want bool
+	}{
+		{"local", true},
+		{"remote", true},
+		{"expired", false},
+		{"remote-expired", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.jti, func(t *testing.T) {
+			model := DenylistModel{cache: cache}
+			if got := model.Contains(tt.jti); got != tt.want {
+				t.Errorf("Contains(%q) = %t; want %t", tt.jti, got, tt.want)
+			}
+		})
+	}
+}
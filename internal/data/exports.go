@@ -0,0 +1,53 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ExportModel stores generated personal data archives. Each archive
+// belongs to a data-export token and is removed together with it.
+type ExportModel struct {
+	DB *sql.DB
+}
+
+func (model ExportModel) Insert(token *Token, archive []byte) error {
+	SQL := `INSERT INTO user_exports (token_hash, user_id, archive)
+			VALUES ($1, $2, $3)`
+
+	args := []interface{}{token.Hash, token.UserID, archive}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := model.DB.ExecContext(ctx, SQL, args...)
+	return err
+}
+
+func (model ExportModel) GetForToken(tokenPlainText string) ([]byte, error) {
+	SQL := `SELECT e.archive FROM user_exports e
+			INNER JOIN tokens t ON t.hash=e.token_hash
+			WHERE t.hash=$1 AND t.scope=$2 AND t.expiry_time > NOW()`
+
+	hashArray := sha256.Sum256([]byte(tokenPlainText))
+
+	args := []interface{}{hashArray[:], ScopeDataExport}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var archive []byte
+	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&archive)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return archive, nil
+}
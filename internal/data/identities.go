@@ -0,0 +1,156 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Identity links an account at an external OpenID Connect
+// provider, named by issuer and subject, to a user
+type Identity struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"-"`
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+func (model IdentityModel) Get(issuer, subject string) (*Identity, error) {
+	SQL := `SELECT id, user_id, issuer, subject, email, created_at
+			FROM user_identities
+			WHERE issuer=$1 AND subject=$2`
+
+	identity := &Identity{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := model.DB.QueryRowContext(ctx, SQL, issuer, subject).Scan(&identity.ID, &identity.UserID, &identity.Issuer, &identity.Subject, &identity.Email, &identity.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return identity, nil
+}
+
+// GetAllForUser returns the external accounts linked to the user
+func (model IdentityModel) GetAllForUser(userID int64) ([]*Identity, error) {
+	SQL := `SELECT id, user_id, issuer, subject, email, created_at
+			FROM user_identities
+			WHERE user_id=$1
+			ORDER BY created_at ASC, id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []*Identity{}
+	for rows.Next() {
+		identity := &Identity{}
+
+		err = rows.Scan(&identity.ID, &identity.UserID, &identity.Issuer, &identity.Subject, &identity.Email, &identity.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, identity)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+func (model IdentityModel) Insert(identity *Identity) error {
+	SQL := `INSERT INTO user_identities (user_id, issuer, subject, email)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, created_at`
+
+	args := []interface{}{identity.UserID, identity.Issuer, identity.Subject, identity.Email}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return model.DB.QueryRowContext(ctx, SQL, args...).Scan(&identity.ID, &identity.CreatedAt)
+}
+
+// OIDCState is what the callback needs to finish a login that was
+// started with a given state parameter
+type OIDCState struct {
+	State      string
+	Verifier   string
+	Nonce      string
+	ExpiryTime time.Time
+}
+
+type OIDCStateModel struct {
+	DB *sql.DB
+}
+
+// Insert stores the state hashed, like tokens, the
+// plaintext only travels through the browser
+func (model OIDCStateModel) Insert(state *OIDCState) error {
+	SQL := `INSERT INTO oidc_states (hash, verifier, nonce, expiry_time)
+			VALUES ($1, $2, $3, $4)`
+
+	hash := sha256.Sum256([]byte(state.State))
+	args := []interface{}{hash[:], state.Verifier, state.Nonce, state.ExpiryTime}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := model.DB.ExecContext(ctx, SQL, args...)
+	return err
+}
+
+// Consume deletes and returns an unexpired state, so
+// each one can only complete a single login
+func (model OIDCStateModel) Consume(plaintext string) (*OIDCState, error) {
+	SQL := `DELETE FROM oidc_states
+			WHERE hash=$1 AND expiry_time > NOW()
+			RETURNING verifier, nonce, expiry_time`
+
+	hash := sha256.Sum256([]byte(plaintext))
+	state := &OIDCState{State: plaintext}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := model.DB.QueryRowContext(ctx, SQL, hash[:]).Scan(&state.Verifier, &state.Nonce, &state.ExpiryTime)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return state, nil
+}
+
+// DeleteExpired clears logins that were started but never finished
+func (model OIDCStateModel) DeleteExpired() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := model.DB.ExecContext(ctx, `DELETE FROM oidc_states WHERE expiry_time <= NOW()`)
+	return err
+}
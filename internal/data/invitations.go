@@ -0,0 +1,173 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/mnabil1718/greenlight/internal/validator"
+)
+
+// Invitation lets someone register while registration is invite-only.
+// The user it creates starts out activated, with Roles and Permissions.
+type Invitation struct {
+	ID          int64      `json:"id"`
+	Plaintext   string     `json:"-"` // only ever sent by email
+	Hash        []byte     `json:"-"`
+	Email       string     `json:"email"`
+	Roles       []string   `json:"roles"`
+	Permissions []string   `json:"permissions"`
+	InvitedBy   *int64     `json:"invited_by,omitempty"`
+	ExpiryTime  time.Time  `json:"expiry_time"`
+	AcceptedAt  *time.Time `json:"accepted_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// ValidateInvitation checks roles and permissions
+// against the ones that exist, when there are any
+func ValidateInvitation(v *validator.Validator, invitation *Invitation, roles []*Role, known Permissions) {
+	ValidateEmail(v, invitation.Email)
+	v.Check(invitation.ExpiryTime.After(time.Now()), "expiry_time", "must be in the future")
+
+	if len(invitation.Roles) > 0 {
+		ValidateRoleNames(v, invitation.Roles, roles)
+	}
+
+	if len(invitation.Permissions) > 0 {
+		ValidatePermissionCodes(v, invitation.Permissions, known)
+	}
+}
+
+type InvitationModel struct {
+	DB *sql.DB
+}
+
+// New generates the invitation code and stores the invitation
+func (model InvitationModel) New(invitation *Invitation) error {
+	plaintext, hash, err := generateSecret(16)
+	if err != nil {
+		return err
+	}
+
+	invitation.Plaintext = plaintext
+	invitation.Hash = hash
+
+	if invitation.Roles == nil {
+		invitation.Roles = []string{}
+	}
+	if invitation.Permissions == nil {
+		invitation.Permissions = []string{}
+	}
+
+	SQL := `INSERT INTO invitations (hash, email, roles, permissions, invited_by, expiry_time)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id, created_at`
+
+	args := []interface{}{invitation.Hash, invitation.Email, invitation.Roles, invitation.Permissions, invitation.InvitedBy, invitation.ExpiryTime}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return model.DB.QueryRowContext(ctx, SQL, args...).Scan(&invitation.ID, &invitation.CreatedAt)
+}
+
+// GetForCode returns an invitation that is neither expired nor accepted
+func (model InvitationModel) GetForCode(plaintext string) (*Invitation, error) {
+	SQL := `SELECT id, email, roles, permissions, invited_by, expiry_time, accepted_at, created_at
+			FROM invitations
+			WHERE hash=$1 AND expiry_time > NOW() AND accepted_at IS NULL`
+
+	hash := sha256.Sum256([]byte(plaintext))
+	invitation := &Invitation{Plaintext: plaintext, Hash: hash[:]}
+
+	m := pgtype.NewMap()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := model.DB.QueryRowContext(ctx, SQL, hash[:]).Scan(
+		&invitation.ID,
+		&invitation.Email,
+		m.SQLScanner(&invitation.Roles),
+		m.SQLScanner(&invitation.Permissions),
+		&invitation.InvitedBy,
+		&invitation.ExpiryTime,
+		&invitation.AcceptedAt,
+		&invitation.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return invitation, nil
+}
+
+// GetForEmail returns the newest invitation sent to the address
+// that is neither expired nor accepted
+func (model InvitationModel) GetForEmail(email string) (*Invitation, error) {
+	SQL := `SELECT id, email, roles, permissions, invited_by, expiry_time, accepted_at, created_at
+			FROM invitations
+			WHERE email=$1 AND expiry_time > NOW() AND accepted_at IS NULL
+			ORDER BY created_at DESC, id DESC
+			LIMIT 1`
+
+	invitation := &Invitation{}
+
+	m := pgtype.NewMap()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := model.DB.QueryRowContext(ctx, SQL, email).Scan(
+		&invitation.ID,
+		&invitation.Email,
+		m.SQLScanner(&invitation.Roles),
+		m.SQLScanner(&invitation.Permissions),
+		&invitation.InvitedBy,
+		&invitation.ExpiryTime,
+		&invitation.AcceptedAt,
+		&invitation.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return invitation, nil
+}
+
+// Accept marks the invitation as used, it returns ErrRecordNotFound
+// when it was accepted by someone else in the meantime
+func (model InvitationModel) Accept(id int64) error {
+	SQL := `UPDATE invitations SET accepted_at = NOW()
+			WHERE id=$1 AND accepted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := model.DB.ExecContext(ctx, SQL, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// failed logins are counted separately for
+// the account and for the client IP address
+const (
+	LoginScopeAccount = "account"
+	LoginScopeIP      = "ip"
+)
+
+type LoginAttempt struct {
+	Scope       string
+	Identifier  string
+	Failures    int
+	Lockouts    int // consecutive lockouts, each one lasts twice as long as the previous
+	LockedUntil *time.Time
+	JustLocked  bool // set when the failure being registered triggered the lockout
+}
+
+func (a *LoginAttempt) Locked() bool {
+	return a.LockedUntil != nil && a.LockedUntil.After(time.Now())
+}
+
+// RetryAfter is how long until the lockout is lifted, zero when not locked
+func (a *LoginAttempt) RetryAfter() time.Duration {
+	if !a.Locked() {
+		return 0
+	}
+	return time.Until(*a.LockedUntil)
+}
+
+type LoginAttemptModel struct {
+	DB *sql.DB
+}
+
+// Get never returns ErrRecordNotFound, a scope and
+// identifier without failures gets an empty attempt
+func (model LoginAttemptModel) Get(scope, identifier string) (*LoginAttempt, error) {
+	SQL := `SELECT failures, lockouts, locked_until
+			FROM login_attempts
+			WHERE scope=$1 AND identifier=$2`
+
+	attempt := &LoginAttempt{Scope: scope, Identifier: identifier}
+	args := []interface{}{scope, identifier}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&attempt.Failures, &attempt.Lockouts, &attempt.LockedUntil)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return attempt, nil
+}
+
+// RegisterFailure counts a failed login and locks the scope once
+// maxFailures is reached. The lockout starts at baseLockout and
+// doubles with every consecutive lockout, up to maxLockout.
+func (model LoginAttemptModel) RegisterFailure(scope, identifier string, maxFailures int, baseLockout, maxLockout time.Duration) (*LoginAttempt, error) {
+	// failures older than a day are forgotten
+	SQL := `INSERT INTO login_attempts (scope, identifier, failures)
+			VALUES ($1, $2, 1)
+			ON CONFLICT (scope, identifier) DO UPDATE
+			SET failures = CASE
+					WHEN login_attempts.last_failure_at < NOW() - INTERVAL '1 day' THEN 1
+					ELSE login_attempts.failures + 1
+				END,
+				last_failure_at = NOW()
+			RETURNING failures, lockouts, locked_until`
+
+	attempt := &LoginAttempt{Scope: scope, Identifier: identifier}
+	args := []interface{}{scope, identifier}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&attempt.Failures, &attempt.Lockouts, &attempt.LockedUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	if attempt.Failures < maxFailures {
+		return attempt, nil
+	}
+
+	lockout := baseLockout
+	for i := 0; i < attempt.Lockouts && lockout < maxLockout; i++ {
+		lockout *= 2
+	}
+	lockout = min(lockout, maxLockout)
+
+	SQL = `UPDATE login_attempts
+			SET failures = 0, lockouts = lockouts + 1, locked_until = NOW() + make_interval(secs => $3)
+			WHERE scope=$1 AND identifier=$2
+			RETURNING failures, lockouts, locked_until`
+
+	args = []interface{}{scope, identifier, lockout.Seconds()}
+
+	err = model.DB.QueryRowContext(ctx, SQL, args...).Scan(&attempt.Failures, &attempt.Lockouts, &attempt.LockedUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	attempt.JustLocked = true
+	return attempt, nil
+}
+
+func (model LoginAttemptModel) Reset(scope, identifier string) error {
+	SQL := `DELETE FROM login_attempts
+			WHERE scope=$1 AND identifier=$2`
+
+	args := []interface{}{scope, identifier}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := model.DB.ExecContext(ctx, SQL, args...)
+	return err
+}
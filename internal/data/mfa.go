@@ -0,0 +1,219 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mnabil1718/greenlight/internal/validator"
+)
+
+// MFA holds a user's TOTP enrollment. The secret is stored
+// encrypted, it's up to the caller to encrypt and decrypt it.
+type MFA struct {
+	UserID       int64
+	Secret       []byte
+	Enabled      bool
+	LastUsedStep int64 // codes from this step or earlier are refused, so a code can't be replayed
+	CreatedAt    time.Time
+	EnabledAt    *time.Time
+}
+
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) == 6, "code", "must be 6 digits long")
+}
+
+// GenerateRecoveryCodes returns n one-time recovery codes formatted
+// for display as XXXXX-XXXXX, along with the hashes to store
+func GenerateRecoveryCodes(n int) ([]string, [][]byte, error) {
+	codes := make([]string, 0, n)
+	hashes := make([][]byte, 0, n)
+
+	for range n {
+		randomBytes := make([]byte, 7)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// recovery codes are compared case and dash insensitively
+func hashRecoveryCode(code string) []byte {
+	normalized := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(normalized))
+	return hash[:]
+}
+
+type MFAModel struct {
+	DB *sql.DB
+}
+
+func (model MFAModel) Get(userID int64) (*MFA, error) {
+	SQL := `SELECT user_id, secret, enabled, last_used_step, created_at, enabled_at
+			FROM users_mfa
+			WHERE user_id=$1`
+
+	mfa := &MFA{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := model.DB.QueryRowContext(ctx, SQL, userID).Scan(&mfa.UserID, &mfa.Secret, &mfa.Enabled, &mfa.LastUsedStep, &mfa.CreatedAt, &mfa.EnabledAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return mfa, nil
+}
+
+// Enroll stores a new, not yet enabled secret for the user. An
+// unconfirmed enrollment is replaced, an enabled one is left alone
+// and ErrEditConflict is returned.
+func (model MFAModel) Enroll(mfa *MFA) error {
+	SQL := `INSERT INTO users_mfa (user_id, secret)
+			VALUES ($1, $2)
+			ON CONFLICT (user_id) DO UPDATE
+			SET secret = EXCLUDED.secret, last_used_step = 0, created_at = NOW()
+			WHERE users_mfa.enabled = false
+			RETURNING created_at`
+
+	args := []interface{}{mfa.UserID, mfa.Secret}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&mfa.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	mfa.Enabled = false
+	mfa.LastUsedStep = 0
+	return nil
+}
+
+// Enable turns on the enrollment and replaces the user's recovery codes
+func (model MFAModel) Enable(userID int64, step int64, recoveryCodeHashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	SQL := `UPDATE users_mfa
+			SET enabled = true, enabled_at = NOW(), last_used_step = $2
+			WHERE user_id = $1 AND enabled = false`
+
+	result, err := tx.ExecContext(ctx, SQL, userID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range recoveryCodeHashes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO mfa_recovery_codes (hash, user_id) VALUES ($1, $2)`, hash, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseStep records that the code for step has been accepted. It reports
+// false when that step, or a later one, was already used.
+func (model MFAModel) UseStep(userID int64, step int64) (bool, error) {
+	SQL := `UPDATE users_mfa
+			SET last_used_step = $2
+			WHERE user_id = $1 AND last_used_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, SQL, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// UseRecoveryCode marks the code as used, it reports false
+// when the code doesn't exist or has already been used
+func (model MFAModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	SQL := `UPDATE mfa_recovery_codes
+			SET used_at = NOW()
+			WHERE hash = $1 AND user_id = $2 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, SQL, hashRecoveryCode(code), userID)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+func (model MFAModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := model.DB.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = model.DB.ExecContext(ctx, `DELETE FROM users_mfa WHERE user_id = $1`, userID)
+	return err
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
@@ -11,39 +12,80 @@ var (
 )
 
 type MovieModelInterface interface {
-	GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error)
+	GetAll(orgID int64, title string, genres []string, createdBy int64, filters Filters) ([]*Movie, Metadata, error)
+	GetAllForUser(userID int64) ([]*Movie, error)
 	Insert(movie *Movie) error
-	Get(id int64) (*Movie, error)
+	Get(orgID int64, id int64) (*Movie, error)
 	Update(movie *Movie) error
-	Delete(id int64) error
+	Delete(orgID int64, id int64) error
 }
 
 type UsersModelInterface interface {
+	GetAll(name string, email string, activated *bool, filters Filters) ([]*User, Metadata, error)
 	Insert(user *User) error
+	Get(id int64) (*User, error)
 	GetByEmail(email string) (*User, error)
 	Update(user *User) error
 	GetForToken(scope string, tokenPlainText string) (*User, error)
+	Delete(id int64) error
+}
+
+type OrganizationModelInterface interface {
+	Insert(org *Organization, ownerID int64) error
+	GetAllForUser(userID int64) ([]*Membership, error)
+	GetMember(orgID, userID int64) (*Membership, error)
+	GetMembers(orgID int64) ([]*Membership, error)
+	SetMember(orgID, userID int64, role string) error
+	RemoveMember(orgID, userID int64) error
 }
 
 type Models struct {
-	Movies      MovieModelInterface
-	Users       UsersModelInterface
-	Tokens      TokenModel
-	Permissions PermissionModel
+	Movies        MovieModelInterface
+	Users         UsersModelInterface
+	Tokens        TokenModel
+	Permissions   PermissionModel
+	Exports       ExportModel
+	Roles         RoleModel
+	LoginAttempts LoginAttemptModel
+	MFA           MFAModel
+	APIKeys       APIKeyModel
+	Denylist      DenylistModel
+	Identities    IdentityModel
+	OIDCStates    OIDCStateModel
+	Invitations   InvitationModel
+	Audit         AuditModel
+	Organizations OrganizationModelInterface
 }
 
-func NewModels(db *sql.DB) Models {
+// permissionsCacheTTL controls how long a user's effective permissions
+// are kept in memory, zero disables the cache
+func NewModels(db *sql.DB, permissionsCacheTTL time.Duration) Models {
+	// shared, so role changes also invalidate cached permissions
+	cache := newPermissionCache(permissionsCacheTTL)
+
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Movies:        MovieModel{DB: db},
+		Users:         UserModel{DB: db},
+		Tokens:        TokenModel{DB: db},
+		Permissions:   PermissionModel{DB: db, cache: cache},
+		Exports:       ExportModel{DB: db},
+		Roles:         RoleModel{DB: db, cache: cache},
+		LoginAttempts: LoginAttemptModel{DB: db},
+		MFA:           MFAModel{DB: db},
+		APIKeys:       APIKeyModel{DB: db},
+		Denylist:      DenylistModel{DB: db, cache: newDenylistCache()},
+		Identities:    IdentityModel{DB: db},
+		OIDCStates:    OIDCStateModel{DB: db},
+		Invitations:   InvitationModel{DB: db},
+		Audit:         AuditModel{DB: db},
+		Organizations: OrganizationModel{DB: db},
 	}
 }
 
 func NewMockModels() Models {
 	return Models{
-		Movies: MockMovieModel{},
-		Users:  MockUserModel{},
+		Movies:        MockMovieModel{},
+		Users:         MockUserModel{},
+		Organizations: MockOrganizationModel{},
 	}
 }
@@ -12,13 +12,15 @@ import (
 )
 
 type Movie struct {
-	ID        int64     `json:"id"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitempty"`
-	Runtime   Runtime   `json:"runtime,omitempty"`
-	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version"`
-	CreatedAt time.Time `json:"-"`
+	ID             int64     `json:"id"`
+	OrganizationID int64     `json:"organization_id"`
+	Title          string    `json:"title"`
+	Year           int32     `json:"year,omitempty"`
+	Runtime        Runtime   `json:"runtime,omitempty"`
+	Genres         []string  `json:"genres,omitempty"`
+	Version        int32     `json:"version"`
+	CreatedBy      *int64    `json:"created_by,omitempty"` // nil for movies added before ownership was tracked
+	CreatedAt      time.Time `json:"-"`
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
@@ -35,23 +37,27 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
 }
 
+// every MovieModel query is filtered by organization_id, so
+// movies never leak from one organization to another
 type MovieModel struct {
 	DB *sql.DB
 }
 
-func (model MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+func (model MovieModel) GetAll(orgID int64, title string, genres []string, createdBy int64, filters Filters) ([]*Movie, Metadata, error) {
 
 	// id is included in ORDER BY to ensure sorting produces the exact order, see: https://www.postgresql.org/docs/current/queries-order.html#QUERIES-ORDER
 	// don't worry, string interpolation is already sanitized
 	SQL := fmt.Sprintf(`
-			SELECT COUNT(*) OVER(), id, title, year, runtime, genres, version, created_at
+			SELECT COUNT(*) OVER(), id, organization_id, title, year, runtime, genres, version, created_by, created_at
 			FROM movies
-			WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-			AND (genres @> $2 OR $2 = '{}')
+			WHERE organization_id = $1
+			AND (to_tsvector('simple', title) @@ plainto_tsquery('simple', $2) OR $2 = '')
+			AND (genres @> $3 OR $3 = '{}')
+			AND (created_by = $4 OR $4 = 0)
 			ORDER BY %s %s, id ASC
-			LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+			LIMIT $5 OFFSET $6`, filters.sortColumn(), filters.sortDirection())
 
-	args := []interface{}{title, genres, filters.limit(), filters.offset()}
+	args := []interface{}{orgID, title, genres, createdBy, filters.limit(), filters.offset()}
 
 	// the timeout starts right after creating this context
 	//  any other operation after this will be counted on timeout
@@ -73,7 +79,7 @@ func (model MovieModel) GetAll(title string, genres []string, filters Filters) (
 		m := pgtype.NewMap()
 		var genres []string
 
-		err := rows.Scan(&totalRecords, &movie.ID, &movie.Title, &movie.Year, &movie.Runtime, m.SQLScanner(&genres), &movie.Version, &movie.CreatedAt)
+		err := rows.Scan(&totalRecords, &movie.ID, &movie.OrganizationID, &movie.Title, &movie.Year, &movie.Runtime, m.SQLScanner(&genres), &movie.Version, &movie.CreatedBy, &movie.CreatedAt)
 		// error from a single row
 		// e.g. error from the scanner
 		if err != nil {
@@ -94,12 +100,53 @@ func (model MovieModel) GetAll(title string, genres []string, filters Filters) (
 	return movies, metadata, nil
 }
 
+// GetAllForUser returns every movie the user has created in the
+// organizations they still belong to, unpaginated
+func (model MovieModel) GetAllForUser(userID int64) ([]*Movie, error) {
+	SQL := `SELECT id, organization_id, title, year, runtime, genres, version, created_by, created_at
+			FROM movies
+			WHERE created_by = $1
+			AND organization_id IN (SELECT organization_id FROM organization_members WHERE user_id = $1)
+			ORDER BY id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		movie := &Movie{}
+
+		m := pgtype.NewMap()
+		var genres []string
+
+		err := rows.Scan(&movie.ID, &movie.OrganizationID, &movie.Title, &movie.Year, &movie.Runtime, m.SQLScanner(&genres), &movie.Version, &movie.CreatedBy, &movie.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		movie.Genres = genres
+		movies = append(movies, movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
+
 func (model MovieModel) Insert(movie *Movie) error {
-	SQL := `INSERT INTO movies (title, year, runtime, genres) 
-			VALUES ($1, $2, $3, $4) 
+	SQL := `INSERT INTO movies (organization_id, title, year, runtime, genres, created_by) 
+			VALUES ($1, $2, $3, $4, $5, $6) 
 			RETURNING id, created_at, version`
 
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, movie.Genres}
+	args := []interface{}{movie.OrganizationID, movie.Title, movie.Year, movie.Runtime, movie.Genres, movie.CreatedBy}
 	// the timeout starts right after creating this context
 	//  any other operation after this will be counted on timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -111,17 +158,17 @@ func (model MovieModel) Insert(movie *Movie) error {
 	return nil
 }
 
-func (model MovieModel) Get(id int64) (*Movie, error) {
+func (model MovieModel) Get(orgID int64, id int64) (*Movie, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
 	movie := &Movie{}
-	SQL := `SELECT id,title,year,runtime, genres,version,created_at
+	SQL := `SELECT id,organization_id,title,year,runtime, genres,version,created_by,created_at
 			FROM movies
-			WHERE id=$1`
+			WHERE id=$1 AND organization_id=$2`
 
-	args := []interface{}{id}
+	args := []interface{}{id, orgID}
 
 	// cannot scan directly into []string, see: https://github.com/jackc/pgx/issues/1779
 	m := pgtype.NewMap()
@@ -131,7 +178,7 @@ func (model MovieModel) Get(id int64) (*Movie, error) {
 	//  any other operation after this will be counted on timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&movie.ID, &movie.Title, &movie.Year, &movie.Runtime, m.SQLScanner(&genres), &movie.Version, &movie.CreatedAt)
+	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&movie.ID, &movie.OrganizationID, &movie.Title, &movie.Year, &movie.Runtime, m.SQLScanner(&genres), &movie.Version, &movie.CreatedBy, &movie.CreatedAt)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -149,10 +196,10 @@ func (model MovieModel) Get(id int64) (*Movie, error) {
 func (model MovieModel) Update(movie *Movie) error {
 	SQL := `UPDATE movies
 			SET title=$1, year=$2, runtime=$3, genres=$4, version = version + 1
-			WHERE id=$5 AND version = $6
+			WHERE id=$5 AND version = $6 AND organization_id=$7
 			RETURNING version`
 
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, movie.Genres, movie.ID, movie.Version}
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, movie.Genres, movie.ID, movie.Version, movie.OrganizationID}
 	// the timeout starts right after creating this context
 	//  any other operation after this will be counted on timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -170,17 +217,17 @@ func (model MovieModel) Update(movie *Movie) error {
 	return nil
 }
 
-func (model MovieModel) Delete(id int64) error {
+func (model MovieModel) Delete(orgID int64, id int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	SQL := `DELETE FROM movies WHERE id=$1`
+	SQL := `DELETE FROM movies WHERE id=$1 AND organization_id=$2`
 	// the timeout starts right after creating this context
 	//  any other operation after this will be counted on timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	result, err := model.DB.ExecContext(ctx, SQL, id)
+	result, err := model.DB.ExecContext(ctx, SQL, id, orgID)
 	if err != nil {
 		return err
 	}
@@ -199,15 +246,19 @@ func (model MovieModel) Delete(id int64) error {
 
 type MockMovieModel struct{}
 
-func (m MockMovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+func (m MockMovieModel) GetAll(orgID int64, title string, genres []string, createdBy int64, filters Filters) ([]*Movie, Metadata, error) {
 	return nil, Metadata{}, nil
 }
 
+func (m MockMovieModel) GetAllForUser(userID int64) ([]*Movie, error) {
+	return nil, nil
+}
+
 func (m MockMovieModel) Insert(movie *Movie) error {
 	return nil
 }
 
-func (m MockMovieModel) Get(id int64) (*Movie, error) {
+func (m MockMovieModel) Get(orgID int64, id int64) (*Movie, error) {
 	return nil, nil
 }
 
@@ -215,6 +266,6 @@ func (m MockMovieModel) Update(movie *Movie) error {
 	return nil
 }
 
-func (m MockMovieModel) Delete(id int64) error {
+func (m MockMovieModel) Delete(orgID int64, id int64) error {
 	return nil
 }
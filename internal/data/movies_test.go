@@ -0,0 +1,181 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// newTestDB connects to the database named by GREENLIGHT_TEST_DB_DSN,
+// which must have every migration applied. Tests using it are skipped
+// when it isn't set.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("GREENLIGHT_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("GREENLIGHT_TEST_DB_DSN is not set")
+	}
+
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// newTestOrganization creates an organization owned by a new user,
+// both removed again when the test ends
+func newTestOrganization(t *testing.T, db *sql.DB, name string) (*Organization, *User) {
+	t.Helper()
+
+	users := UserModel{DB: db}
+	orgs := OrganizationModel{DB: db}
+
+	user := &User{
+		Name:      name,
+		Email:     fmt.Sprintf("%s-%d@example.com", name, time.Now().UnixNano()),
+		Activated: true,
+	}
+
+	err := user.Password.Set("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { users.Delete(user.ID) })
+
+	org := &Organization{Name: name}
+
+	err = orgs.Insert(org, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DELETE FROM organizations WHERE id=$1`, org.ID) })
+
+	return org, user
+}
+
+func TestMovieModelOrganizationIsolation(t *testing.T) {
+	db := newTestDB(t)
+	movies := MovieModel{DB: db}
+
+	orgA, userA := newTestOrganization(t, db, "org-a")
+	orgB, _ := newTestOrganization(t, db, "org-b")
+
+	movie := &Movie{
+		OrganizationID: orgA.ID,
+		Title:          "Moana",
+		Year:           2016,
+		Runtime:        107,
+		Genres:         []string{"animation", "adventure"},
+		CreatedBy:      &userA.ID,
+	}
+
+	err := movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filters := Filters{Sort: "id", Page: 1, PageSize: 100, SortSafelist: []string{"id"}}
+
+	t.Run("Get", func(t *testing.T) {
+		_, err := movies.Get(orgB.ID, movie.ID)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("got error %v from another organization; want %v", err, ErrRecordNotFound)
+		}
+
+		got, err := movies.Get(orgA.ID, movie.ID)
+		if err != nil {
+			t.Fatalf("got error %v from the movie's organization", err)
+		}
+		if got.OrganizationID != orgA.ID {
+			t.Errorf("got organization %d; want %d", got.OrganizationID, orgA.ID)
+		}
+	})
+
+	t.Run("GetAll", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			orgID int64
+			want  bool
+		}{
+			{"own organization", orgA.ID, true},
+			{"other organization", orgB.ID, false},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				list, _, err := movies.GetAll(tt.orgID, "", []string{}, 0, filters)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				found := false
+				for _, m := range list {
+					if m.OrganizationID != tt.orgID {
+						t.Errorf("listed movie %d of organization %d", m.ID, m.OrganizationID)
+					}
+					if m.ID == movie.ID {
+						found = true
+					}
+				}
+
+				if found != tt.want {
+					t.Errorf("movie listed = %t; want %t", found, tt.want)
+				}
+			})
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		update := *movie
+		update.OrganizationID = orgB.ID
+		update.Title = "Hijacked"
+
+		err := movies.Update(&update)
+		if !errors.Is(err, ErrEditConflict) {
+			t.Errorf("got error %v from another organization; want %v", err, ErrEditConflict)
+		}
+
+		got, err := movies.Get(orgA.ID, movie.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Title != movie.Title {
+			t.Errorf("got title %q; want %q", got.Title, movie.Title)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		err := movies.Delete(orgB.ID, movie.ID)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("got error %v from another organization; want %v", err, ErrRecordNotFound)
+		}
+
+		_, err = movies.Get(orgA.ID, movie.ID)
+		if err != nil {
+			t.Errorf("movie is gone after a delete from another organization: %v", err)
+		}
+
+		err = movies.Delete(orgA.ID, movie.ID)
+		if err != nil {
+			t.Errorf("got error %v from the movie's organization", err)
+		}
+	})
+}
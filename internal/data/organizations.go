@@ -0,0 +1,318 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/mnabil1718/greenlight/internal/validator"
+)
+
+const (
+	OrganizationRoleOwner  = "owner"
+	OrganizationRoleAdmin  = "admin"
+	OrganizationRoleMember = "member"
+	OrganizationRoleViewer = "viewer"
+)
+
+var (
+	ErrLastOwner = errors.New("organization must keep at least one owner")
+)
+
+// each role can do everything the roles ranked below it can
+var organizationRoleRanks = map[string]int{
+	OrganizationRoleViewer: 1,
+	OrganizationRoleMember: 2,
+	OrganizationRoleAdmin:  3,
+	OrganizationRoleOwner:  4,
+}
+
+// Organization is a tenant. Movies belong to exactly one
+// and are only visible to its members.
+type Organization struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Version   int32     `json:"version"`
+	CreatedAt time.Time `json:"-"`
+}
+
+// Membership is the role a user holds in an organization
+type Membership struct {
+	OrganizationID   int64     `json:"organization_id"`
+	OrganizationName string    `json:"organization_name,omitempty"`
+	UserID           int64     `json:"user_id"`
+	Email            string    `json:"email,omitempty"`
+	Role             string    `json:"role"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// HasRole reports whether the member holds role or one ranked above it
+func (m *Membership) HasRole(role string) bool {
+	return organizationRoleRanks[m.Role] >= organizationRoleRanks[role]
+}
+
+func ValidateOrganization(v *validator.Validator, org *Organization) {
+	v.Check(org.Name != "", "name", "must be provided")
+	v.Check(len(org.Name) <= 100, "name", "must not be more than 100 bytes long")
+}
+
+func ValidateOrganizationRole(v *validator.Validator, role string) {
+	v.Check(role != "", "role", "must be provided")
+	v.Check(v.In(role, OrganizationRoleOwner, OrganizationRoleAdmin, OrganizationRoleMember, OrganizationRoleViewer), "role", "must be one of owner, admin, member or viewer")
+}
+
+type OrganizationModel struct {
+	DB *sql.DB
+}
+
+// Insert creates the organization with ownerID as its first owner
+func (model OrganizationModel) Insert(org *Organization, ownerID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	SQL := `INSERT INTO organizations (name)
+			VALUES ($1)
+			RETURNING id, created_at, version`
+
+	err = tx.QueryRowContext(ctx, SQL, org.Name).Scan(&org.ID, &org.CreatedAt, &org.Version)
+	if err != nil {
+		return err
+	}
+
+	SQL = `INSERT INTO organization_members (organization_id, user_id, role)
+			VALUES ($1, $2, $3)`
+
+	_, err = tx.ExecContext(ctx, SQL, org.ID, ownerID, OrganizationRoleOwner)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetAllForUser returns the user's memberships along with the
+// names of the organizations
+func (model OrganizationModel) GetAllForUser(userID int64) ([]*Membership, error) {
+	SQL := `SELECT om.organization_id, o.name, om.user_id, om.role, om.created_at
+			FROM organization_members om
+			INNER JOIN organizations o ON om.organization_id=o.id
+			WHERE om.user_id=$1
+			ORDER BY om.organization_id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []*Membership{}
+	for rows.Next() {
+		membership := &Membership{}
+
+		err = rows.Scan(&membership.OrganizationID, &membership.OrganizationName, &membership.UserID, &membership.Role, &membership.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		memberships = append(memberships, membership)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return memberships, nil
+}
+
+// GetMember returns the user's membership in the organization,
+// ErrRecordNotFound if they don't belong to it
+func (model OrganizationModel) GetMember(orgID, userID int64) (*Membership, error) {
+	if orgID < 1 || userID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	SQL := `SELECT om.organization_id, o.name, om.user_id, om.role, om.created_at
+			FROM organization_members om
+			INNER JOIN organizations o ON om.organization_id=o.id
+			WHERE om.organization_id=$1 AND om.user_id=$2`
+
+	membership := &Membership{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := model.DB.QueryRowContext(ctx, SQL, orgID, userID).Scan(&membership.OrganizationID, &membership.OrganizationName, &membership.UserID, &membership.Role, &membership.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return membership, nil
+}
+
+func (model OrganizationModel) GetMembers(orgID int64) ([]*Membership, error) {
+	SQL := `SELECT om.organization_id, om.user_id, u.email, om.role, om.created_at
+			FROM organization_members om
+			INNER JOIN users u ON om.user_id=u.id
+			WHERE om.organization_id=$1
+			ORDER BY om.user_id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*Membership{}
+	for rows.Next() {
+		member := &Membership{}
+
+		err = rows.Scan(&member.OrganizationID, &member.UserID, &member.Email, &member.Role, &member.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		members = append(members, member)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// SetMember adds the user to the organization or changes their role.
+// It returns ErrLastOwner instead of demoting the only owner.
+func (model OrganizationModel) SetMember(orgID, userID int64, role string) error {
+	return model.changeMembers(orgID, func(ctx context.Context, tx *sql.Tx) error {
+		SQL := `INSERT INTO organization_members (organization_id, user_id, role)
+				VALUES ($1, $2, $3)
+				ON CONFLICT (organization_id, user_id) DO UPDATE SET role=EXCLUDED.role`
+
+		_, err := tx.ExecContext(ctx, SQL, orgID, userID, role)
+		return err
+	})
+}
+
+// RemoveMember takes the user out of the organization.
+// It returns ErrLastOwner instead of removing the only owner.
+func (model OrganizationModel) RemoveMember(orgID, userID int64) error {
+	return model.changeMembers(orgID, func(ctx context.Context, tx *sql.Tx) error {
+		SQL := `DELETE FROM organization_members WHERE organization_id=$1 AND user_id=$2`
+
+		result, err := tx.ExecContext(ctx, SQL, orgID, userID)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+
+		return nil
+	})
+}
+
+// changeMembers runs apply with the organization row locked, so
+// concurrent changes can't leave it without an owner between them.
+// Organizations that have no owner to begin with can still change.
+func (model OrganizationModel) changeMembers(orgID int64, apply func(ctx context.Context, tx *sql.Tx) error) error {
+	if orgID < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	SQL := `SELECT id FROM organizations WHERE id=$1 FOR UPDATE`
+
+	err = tx.QueryRowContext(ctx, SQL, orgID).Scan(&orgID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	SQL = `SELECT COUNT(*) FROM organization_members WHERE organization_id=$1 AND role=$2`
+
+	var before int
+	err = tx.QueryRowContext(ctx, SQL, orgID, OrganizationRoleOwner).Scan(&before)
+	if err != nil {
+		return err
+	}
+
+	err = apply(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	var after int
+	err = tx.QueryRowContext(ctx, SQL, orgID, OrganizationRoleOwner).Scan(&after)
+	if err != nil {
+		return err
+	}
+
+	if before > 0 && after == 0 {
+		return ErrLastOwner
+	}
+
+	return tx.Commit()
+}
+
+type MockOrganizationModel struct{}
+
+func (m MockOrganizationModel) Insert(org *Organization, ownerID int64) error {
+	return nil
+}
+
+func (m MockOrganizationModel) GetAllForUser(userID int64) ([]*Membership, error) {
+	return nil, nil
+}
+
+func (m MockOrganizationModel) GetMember(orgID, userID int64) (*Membership, error) {
+	return nil, nil
+}
+
+func (m MockOrganizationModel) GetMembers(orgID int64) ([]*Membership, error) {
+	return nil, nil
+}
+
+func (m MockOrganizationModel) SetMember(orgID, userID int64, role string) error {
+	return nil
+}
+
+func (m MockOrganizationModel) RemoveMember(orgID, userID int64) error {
+	return nil
+}
@@ -0,0 +1,202 @@
+package data
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/mnabil1718/greenlight/internal/validator"
+)
+
+// PasswordRule is one check of the password policy. Rules report
+// problems with the password through v, the error is for failures
+// to run the check at all.
+type PasswordRule interface {
+	Check(v *validator.Validator, plaintext string, user *User) error
+}
+
+// PasswordPolicy runs on top of ValidatePasswordPlaintext wherever
+// a user picks a new password
+type PasswordPolicy struct {
+	Rules []PasswordRule
+}
+
+var passwordPolicy = PasswordPolicy{
+	Rules: []PasswordRule{MinEntropyRule{Bits: 35}, PersonalInfoRule{}},
+}
+
+// SetPasswordPolicy is meant to be called once at startup
+func SetPasswordPolicy(policy PasswordPolicy) {
+	passwordPolicy = policy
+}
+
+// ValidatePasswordPolicy checks plaintext, the new password of user,
+// against every rule of the configured policy. Rules report under the
+// same key, so their messages are joined to show every broken rule.
+func ValidatePasswordPolicy(v *validator.Validator, plaintext string, user *User) error {
+	keys := []string{}
+	messages := map[string][]string{}
+
+	for _, rule := range passwordPolicy.Rules {
+		ruleValidator := validator.New()
+
+		err := rule.Check(ruleValidator, plaintext, user)
+		if err != nil {
+			return err
+		}
+
+		for key, message := range ruleValidator.Errors {
+			if _, ok := messages[key]; !ok {
+				keys = append(keys, key)
+			}
+			messages[key] = append(messages[key], message)
+		}
+	}
+
+	for _, key := range keys {
+		v.AddError(key, strings.Join(messages[key], "; "))
+	}
+	return nil
+}
+
+// MinEntropyRule rejects passwords with an estimated strength below
+// Bits. The estimate is the number of characters times the bits each
+// one adds given the kinds of characters used, where repeated and
+// sequential characters like "aaa" or "123" only count once.
+type MinEntropyRule struct {
+	Bits float64
+}
+
+func (rule MinEntropyRule) Check(v *validator.Validator, plaintext string, user *User) error {
+	v.Check(passwordEntropy(plaintext) >= rule.Bits, "password", "is too easy to guess, use a longer password or mix in other kinds of characters")
+	return nil
+}
+
+func passwordEntropy(plaintext string) float64 {
+	var lower, upper, digit, symbol, other bool
+	var length int
+	var previous rune = -1
+
+	for _, r := range plaintext {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+
+		if r != previous && r != previous+1 && r != previous-1 {
+			length++
+		}
+		previous = r
+	}
+
+	pool := 0
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if symbol {
+		pool += 33
+	}
+	if other {
+		pool += 100
+	}
+
+	if pool == 0 {
+		return 0
+	}
+
+	return float64(length) * math.Log2(float64(pool))
+}
+
+// PersonalInfoRule rejects passwords containing the user's name, or the
+// address or local part of their email. Parts shorter than 3 characters
+// are ignored, they would rule out too much.
+type PersonalInfoRule struct{}
+
+func (rule PersonalInfoRule) Check(v *validator.Validator, plaintext string, user *User) error {
+	if user == nil {
+		return nil
+	}
+
+	password := strings.ToLower(plaintext)
+
+	parts := strings.Fields(strings.ToLower(user.Name))
+	if user.Email != "" {
+		email := strings.ToLower(user.Email)
+		localPart, _, _ := strings.Cut(email, "@")
+		parts = append(parts, email, localPart)
+	}
+
+	for _, part := range parts {
+		if len(part) >= 3 && strings.Contains(password, part) {
+			v.AddError("password", "must not contain your name or email address")
+			break
+		}
+	}
+
+	return nil
+}
+
+// BreachedPasswordRule rejects passwords found in a local copy of a
+// breached password corpus, laid out like the k-anonymity range API
+// of Have I Been Pwned: Dir holds one file per 5 character uppercase
+// hex prefix of the SHA-1 hash, listing "SUFFIX:COUNT" lines. Only the
+// file of the password's prefix is read.
+type BreachedPasswordRule struct {
+	Dir string
+}
+
+func (rule BreachedPasswordRule) Check(v *validator.Validator, plaintext string, user *User) error {
+	breached, err := rule.contains(plaintext)
+	if err != nil {
+		return err
+	}
+
+	v.Check(!breached, "password", "has appeared in a data breach, choose a different password")
+	return nil
+}
+
+func (rule BreachedPasswordRule) contains(plaintext string) (bool, error) {
+	sum := sha1.Sum([]byte(plaintext))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(rule.Dir, prefix))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineSuffix, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(lineSuffix, suffix) {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
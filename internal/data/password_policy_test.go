@@ -0,0 +1,25 @@
+package data
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mnabil1718/greenlight/internal/validator"
+)
+
+func TestValidatePasswordPolicyReportsEveryRule(t *testing.T) {
+	user := &User{Name: "Alice", Email: "alice@example.com"}
+
+	v := validator.New()
+
+	err := ValidatePasswordPolicy(v, "alice", user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"too easy to guess", "must not contain your name"} {
+		if !strings.Contains(v.Errors["password"], want) {
+			t.Errorf("got password error %q; want it to contain %q", v.Errors["password"], want)
+		}
+	}
+}
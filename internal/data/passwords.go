@@ -0,0 +1,188 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PasswordBcrypt   = "bcrypt"
+	PasswordArgon2id = "argon2id"
+)
+
+// bcrypt ignores everything past 72 bytes, argon2id has no such
+// limit but the cap keeps hashing huge inputs off the table. Logins
+// only get the larger bound, a password set under another algorithm
+// has to keep working after the configured one changes.
+const (
+	maxBcryptPasswordLength   = 72
+	maxArgon2idPasswordLength = 1024
+	maxLoginPasswordLength    = 4096
+)
+
+var ErrInvalidPasswordHash = errors.New("invalid password hash")
+
+// PasswordConfig picks the algorithm and cost of new hashes. Hashes
+// made with anything else keep working and are upgraded on login.
+type PasswordConfig struct {
+	Algorithm     string
+	BcryptCost    int
+	Argon2Memory  uint32 // in KiB
+	Argon2Time    uint32
+	Argon2Threads uint8
+}
+
+var DefaultPasswordConfig = PasswordConfig{
+	Algorithm:     PasswordArgon2id,
+	BcryptCost:    12,
+	Argon2Memory:  64 * 1024,
+	Argon2Time:    3,
+	Argon2Threads: 2,
+}
+
+var passwordConfig = DefaultPasswordConfig
+
+// SetPasswordConfig is meant to be called once at startup
+func SetPasswordConfig(cfg PasswordConfig) error {
+	switch cfg.Algorithm {
+	case PasswordBcrypt:
+		if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case PasswordArgon2id:
+		if cfg.Argon2Memory < 8*uint32(cfg.Argon2Threads) || cfg.Argon2Time < 1 || cfg.Argon2Threads < 1 {
+			return errors.New("argon2id needs a time and threads of at least 1, and 8 KiB of memory per thread")
+		}
+	default:
+		return fmt.Errorf("unsupported password algorithm %q", cfg.Algorithm)
+	}
+
+	passwordConfig = cfg
+	return nil
+}
+
+func maxPasswordLength() int {
+	if passwordConfig.Algorithm == PasswordBcrypt {
+		return maxBcryptPasswordLength
+	}
+	return maxArgon2idPasswordLength
+}
+
+// argon2idParams is what the PHC string of an argon2id hash records,
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+type argon2idParams struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func hashPassword(plaintext string) ([]byte, error) {
+	if passwordConfig.Algorithm == PasswordBcrypt {
+		return bcrypt.GenerateFromPassword([]byte(plaintext), passwordConfig.BcryptCost)
+	}
+
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintext), salt, passwordConfig.Argon2Time, passwordConfig.Argon2Memory, passwordConfig.Argon2Threads, 32)
+
+	hash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, passwordConfig.Argon2Memory, passwordConfig.Argon2Time, passwordConfig.Argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	return []byte(hash), nil
+}
+
+func parseArgon2id(hash []byte) (*argon2idParams, error) {
+	parts := bytes.Split(hash, []byte("$"))
+	if len(parts) != 6 || string(parts[1]) != PasswordArgon2id {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(string(parts[2]), "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	params := &argon2idParams{}
+	_, err = fmt.Sscanf(string(parts[3]), "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	params.salt, err = base64.RawStdEncoding.DecodeString(string(parts[4]))
+	if err != nil {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	params.key, err = base64.RawStdEncoding.DecodeString(string(parts[5]))
+	if err != nil || len(params.key) == 0 {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	return params, nil
+}
+
+// comparePassword works out the algorithm from the hash itself
+func comparePassword(hash []byte, plaintext string) (bool, error) {
+	if bytes.HasPrefix(hash, []byte("$argon2id$")) {
+		params, err := parseArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+
+		key := argon2.IDKey([]byte(plaintext), params.salt, params.time, params.memory, params.threads, uint32(len(params.key)))
+		return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+	}
+
+	// bcrypt hashes from before argon2id was supported have no marker of our own
+	err := bcrypt.CompareHashAndPassword(hash, []byte(plaintext))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// passwordNeedsRehash reports whether hash was made with another
+// algorithm or cost than the one currently configured
+func passwordNeedsRehash(hash []byte) bool {
+	if bytes.HasPrefix(hash, []byte("$argon2id$")) {
+		if passwordConfig.Algorithm != PasswordArgon2id {
+			return true
+		}
+
+		params, err := parseArgon2id(hash)
+		if err != nil {
+			return true
+		}
+
+		return params.memory != passwordConfig.Argon2Memory ||
+			params.time != passwordConfig.Argon2Time ||
+			params.threads != passwordConfig.Argon2Threads
+	}
+
+	if passwordConfig.Algorithm != PasswordBcrypt {
+		return true
+	}
+
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != passwordConfig.BcryptCost
+}
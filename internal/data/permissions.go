@@ -4,29 +4,91 @@ import (
 	"context"
 	"database/sql"
 	"time"
+
+	"github.com/mnabil1718/greenlight/internal/validator"
 )
 
 type Permissions []string
 
+// Include reports whether the permissions grant code, either
+// directly, through a wildcard pattern or through an implication
 func (p Permissions) Include(code string) bool {
-	for _, permission := range p {
-		if permission == code {
-			return true
+	for _, candidate := range implyingPermissions(code) {
+		for _, permission := range p {
+			if matchPermission(permission, candidate) {
+				return true
+			}
 		}
 	}
 
 	return false
 }
 
+// ValidatePermissionCodes checks that every requested code is one of
+// the known codes in the permissions table or a valid wildcard pattern
+func ValidatePermissionCodes(v *validator.Validator, codes []string, known Permissions) {
+	v.Check(len(codes) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(codes), "permissions", "must not contain duplicate values")
+	for _, code := range codes {
+		validatePermissionCode(v, "permissions", code, known)
+	}
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
 type PermissionModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	cache *permissionCache
+}
+
+func (model PermissionModel) GetAll() (Permissions, error) {
+	SQL := `SELECT code FROM permissions ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+	for rows.Next() {
+		var code string
+		err = rows.Scan(&code)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, code)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
 }
 
 func (model PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	if permissions, ok := model.cache.get(userID); ok {
+		return permissions, nil
+	}
+
+	// effective permissions are the direct grants plus
+	// everything granted through the user's roles
 	SQL := `SELECT p.code FROM permissions p 
 			INNER JOIN users_permissions up ON up.permission_id=p.id
-			INNER JOIN users u ON up.user_id=u.id
-			WHERE u.id=$1`
+			WHERE up.user_id=$1
+			UNION
+			SELECT p.code FROM permissions p
+			INNER JOIN roles_permissions rp ON rp.permission_id=p.id
+			INNER JOIN users_roles ur ON ur.role_id=rp.role_id
+			WHERE ur.user_id=$1`
 
 	args := []interface{}{userID}
 
@@ -54,12 +116,56 @@ func (model PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		return nil, err
 	}
 
+	model.cache.set(userID, permissions)
+
 	return permissions, nil
 }
 
 func (model PermissionModel) AddForUser(userID int64, permissionCode ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := insertPermissionPatterns(ctx, model.DB, permissionCode)
+	if err != nil {
+		return err
+	}
+
 	SQL := `INSERT INTO users_permissions (user_id, permission_id)
-			SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+			SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+			ON CONFLICT DO NOTHING`
+
+	args := []interface{}{userID, permissionCode}
+
+	_, err = model.DB.ExecContext(ctx, SQL, args...)
+	model.cache.invalidate(userID)
+	return err
+}
+
+// insertPermissionPatterns adds the wildcard patterns among codes to
+// the permissions table, so they can be granted like any other code
+func insertPermissionPatterns(ctx context.Context, db execer, codes []string) error {
+	patterns := []string{}
+	for _, code := range codes {
+		if IsPermissionPattern(code) {
+			patterns = append(patterns, code)
+		}
+	}
+
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	SQL := `INSERT INTO permissions (code)
+			SELECT unnest($1::text[])
+			ON CONFLICT (code) DO NOTHING`
+
+	_, err := db.ExecContext(ctx, SQL, patterns)
+	return err
+}
+
+func (model PermissionModel) RemoveForUser(userID int64, permissionCode ...string) error {
+	SQL := `DELETE FROM users_permissions
+			WHERE user_id = $1 AND permission_id IN (SELECT permissions.id FROM permissions WHERE permissions.code = ANY($2))`
 
 	args := []interface{}{userID, permissionCode}
 
@@ -67,5 +173,6 @@ func (model PermissionModel) AddForUser(userID int64, permissionCode ...string)
 	defer cancel()
 
 	_, err := model.DB.ExecContext(ctx, SQL, args...)
+	model.cache.invalidate(userID)
 	return err
 }
@@ -0,0 +1,87 @@
+package data
+
+import (
+	"sync"
+	"time"
+)
+
+// permissionCache keeps the effective permissions of recently seen
+// users in memory, so requirePermission doesn't hit the database on
+// every request. Entries expire after ttl; grant changes made through
+// the models invalidate them right away. A ttl of zero disables it.
+type permissionCache struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	entries map[int64]permissionCacheEntry
+}
+
+type permissionCacheEntry struct {
+	permissions Permissions
+	expiresAt   time.Time
+}
+
+func newPermissionCache(ttl time.Duration) *permissionCache {
+	return &permissionCache{
+		ttl:     ttl,
+		entries: make(map[int64]permissionCacheEntry),
+	}
+}
+
+func (c *permissionCache) get(userID int64) (Permissions, bool) {
+	if c == nil || c.ttl <= 0 {
+		return nil, false
+	}
+
+	c.mu.RLock()
+	entry, ok := c.entries[userID]
+	c.mu.RUnlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expiresAt) {
+		c.invalidate(userID)
+		return nil, false
+	}
+
+	return entry.permissions, true
+}
+
+func (c *permissionCache) set(userID int64, permissions Permissions) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[userID] = permissionCacheEntry{
+		permissions: permissions,
+		expiresAt:   time.Now().Add(c.ttl),
+	}
+}
+
+func (c *permissionCache) invalidate(userID int64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, userID)
+}
+
+// invalidateAll is used when a change can affect any number of
+// users, e.g. when the permissions of a role are edited
+func (c *permissionCache) invalidateAll() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[int64]permissionCacheEntry)
+}
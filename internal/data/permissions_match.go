@@ -0,0 +1,88 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mnabil1718/greenlight/internal/validator"
+)
+
+// PermissionWildcard grants every permission when held on its own, and
+// every permission of a resource when used as the action, e.g. "movies:*"
+const PermissionWildcard = "*"
+
+// impliedPermissions lists what holding a code grants on top of
+// the code itself. Implications are followed transitively.
+var impliedPermissions = map[string][]string{
+	"movies:admin": {"movies:write"},
+	"movies:write": {"movies:read"},
+}
+
+// IsPermissionPattern reports whether code is a wildcard pattern
+// rather than a concrete permission code
+func IsPermissionPattern(code string) bool {
+	return code == PermissionWildcard || strings.HasSuffix(code, ":"+PermissionWildcard)
+}
+
+// matchPermission reports whether a granted code or pattern covers code
+func matchPermission(granted, code string) bool {
+	switch {
+	case granted == PermissionWildcard:
+		return true
+	case IsPermissionPattern(granted):
+		return strings.HasPrefix(code, strings.TrimSuffix(granted, PermissionWildcard))
+	default:
+		return granted == code
+	}
+}
+
+// implyingPermissions returns code together with every
+// code that implies it, directly or through other codes
+func implyingPermissions(code string) []string {
+	codes := []string{code}
+
+	for i := 0; i < len(codes); i++ {
+		for implying, implied := range impliedPermissions {
+			for _, c := range implied {
+				if c == codes[i] && !contains(codes, implying) {
+					codes = append(codes, implying)
+				}
+			}
+		}
+	}
+
+	return codes
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePermissionCode accepts codes from the permissions table and
+// wildcard patterns that cover at least one of those codes
+func validatePermissionCode(v *validator.Validator, key string, code string, known Permissions) {
+	if !IsPermissionPattern(code) {
+		v.Check(contains(known, code), key, fmt.Sprintf("unknown permission code %q", code))
+		return
+	}
+
+	if code == PermissionWildcard {
+		return
+	}
+
+	resource := strings.TrimSuffix(code, ":"+PermissionWildcard)
+	v.Check(resource != "" && !strings.Contains(resource, PermissionWildcard), key, fmt.Sprintf("invalid permission pattern %q", code))
+
+	for _, c := range known {
+		if !IsPermissionPattern(c) && matchPermission(code, c) {
+			return
+		}
+	}
+
+	v.AddError(key, fmt.Sprintf("permission pattern %q does not match any permission code", code))
+}
@@ -0,0 +1,154 @@
+package data
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/mnabil1718/greenlight/internal/validator"
+)
+
+var knownPermissions = Permissions{"*", "movies:read", "movies:write", "movies:admin", "admin:users", "admin:impersonate", "permissions:admin"}
+
+func TestIsPermissionPattern(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"*", true},
+		{"movies:*", true},
+		{"movies:read", false},
+		{"movies:", false},
+		{":read", false},
+		{"mo*vies:read", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			if got := IsPermissionPattern(tt.code); got != tt.want {
+				t.Errorf("IsPermissionPattern(%q) = %t; want %t", tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchPermission(t *testing.T) {
+	tests := []struct {
+		granted string
+		code    string
+		want    bool
+	}{
+		{"*", "movies:read", true},
+		{"*", "admin:users", true},
+		{"movies:*", "movies:read", true},
+		{"movies:*", "movies:admin", true},
+		{"movies:*", "admin:users", false},
+		{"movies:*", "moviesx:read", false},
+		{"movies:read", "movies:read", true},
+		{"movies:read", "movies:write", false},
+		{"movies:", "movies:read", false},
+		{":read", "movies:read", false},
+		{"mo*vies:read", "movies:read", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.granted+" "+tt.code, func(t *testing.T) {
+			if got := matchPermission(tt.granted, tt.code); got != tt.want {
+				t.Errorf("matchPermission(%q, %q) = %t; want %t", tt.granted, tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImplyingPermissions(t *testing.T) {
+	tests := []struct {
+		code string
+		want []string
+	}{
+		{"movies:read", []string{"movies:admin", "movies:read", "movies:write"}},
+		{"movies:write", []string{"movies:admin", "movies:write"}},
+		{"movies:admin", []string{"movies:admin"}},
+		{"admin:users", []string{"admin:users"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			got := implyingPermissions(tt.code)
+			sort.Strings(got)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("implyingPermissions(%q) = %v; want %v", tt.code, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("implyingPermissions(%q) = %v; want %v", tt.code, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPermissionsInclude(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions Permissions
+		code        string
+		want        bool
+	}{
+		{"exact code", Permissions{"movies:read"}, "movies:read", true},
+		{"other code", Permissions{"movies:read"}, "movies:write", false},
+		{"no permissions", Permissions{}, "movies:read", false},
+		{"wildcard", Permissions{"*"}, "admin:users", true},
+		{"resource wildcard", Permissions{"movies:*"}, "movies:write", true},
+		{"resource wildcard of other resource", Permissions{"movies:*"}, "admin:users", false},
+		{"admin implies write", Permissions{"movies:admin"}, "movies:write", true},
+		{"admin implies read", Permissions{"movies:admin"}, "movies:read", true},
+		{"write implies read", Permissions{"movies:write"}, "movies:read", true},
+		{"read does not imply write", Permissions{"movies:read"}, "movies:write", false},
+		{"write does not imply admin", Permissions{"movies:write"}, "movies:admin", false},
+		{"malformed trailing colon", Permissions{"movies:"}, "movies:read", false},
+		{"malformed leading colon", Permissions{":read"}, "movies:read", false},
+		{"malformed inner wildcard", Permissions{"mo*vies:read"}, "movies:read", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.permissions.Include(tt.code); got != tt.want {
+				t.Errorf("%v.Include(%q) = %t; want %t", tt.permissions, tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePermissionCode(t *testing.T) {
+	tests := []struct {
+		code  string
+		valid bool
+	}{
+		{"*", true},
+		{"movies:*", true},
+		{"admin:*", true},
+		{"movies:read", true},
+		{"movies:admin", true},
+		{"movies:delete", false},
+		{"series:*", false},
+		{"movies:", false},
+		{":read", false},
+		{":*", false},
+		{"*:*", false},
+		{"mo*vies:read", false},
+		{"mo*vies:*", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			v := validator.New()
+			validatePermissionCode(v, "permissions", tt.code, knownPermissions)
+
+			if v.Valid() != tt.valid {
+				t.Errorf("validatePermissionCode(%q) valid = %t; want %t, errors: %v", tt.code, v.Valid(), tt.valid, v.Errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/mnabil1718/greenlight/internal/validator"
+)
+
+var (
+	ErrDuplicateRoleName = errors.New("duplicate role name")
+)
+
+// Role is a named bundle of permissions. Users holding a role
+// get all of its permissions on top of their direct grants.
+type Role struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Permissions Permissions `json:"permissions"`
+	Version     int32       `json:"version"`
+	CreatedAt   time.Time   `json:"-"`
+}
+
+func ValidateRole(v *validator.Validator, role *Role, known Permissions) {
+	v.Check(role.Name != "", "name", "must be provided")
+	v.Check(len(role.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(role.Description) <= 500, "description", "must not be more than 500 bytes long")
+	v.Check(role.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range role.Permissions {
+		validatePermissionCode(v, "permissions", code, known)
+	}
+}
+
+// ValidateRoleNames checks that every requested name is an existing role
+func ValidateRoleNames(v *validator.Validator, names []string, roles []*Role) {
+	v.Check(len(names) >= 1, "roles", "must contain at least 1 role")
+	v.Check(validator.Unique(names), "roles", "must not contain duplicate values")
+
+	known := make([]string, 0, len(roles))
+	for _, role := range roles {
+		known = append(known, role.Name)
+	}
+
+	for _, name := range names {
+		v.Check(v.In(name, known...), "roles", fmt.Sprintf("unknown role %q", name))
+	}
+}
+
+type RoleModel struct {
+	DB    *sql.DB
+	cache *permissionCache
+}
+
+func (model RoleModel) GetAll() ([]*Role, error) {
+	SQL := `SELECT r.id, r.name, r.description, r.version, r.created_at,
+			COALESCE(array_agg(p.code ORDER BY p.code) FILTER (WHERE p.code IS NOT NULL), '{}')
+			FROM roles r
+			LEFT JOIN roles_permissions rp ON rp.role_id=r.id
+			LEFT JOIN permissions p ON rp.permission_id=p.id
+			GROUP BY r.id
+			ORDER BY r.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+	for rows.Next() {
+		role := &Role{}
+
+		m := pgtype.NewMap()
+		var permissions []string
+
+		err = rows.Scan(&role.ID, &role.Name, &role.Description, &role.Version, &role.CreatedAt, m.SQLScanner(&permissions))
+		if err != nil {
+			return nil, err
+		}
+
+		role.Permissions = permissions
+		roles = append(roles, role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func (model RoleModel) Get(id int64) (*Role, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	SQL := `SELECT r.id, r.name, r.description, r.version, r.created_at,
+			COALESCE(array_agg(p.code ORDER BY p.code) FILTER (WHERE p.code IS NOT NULL), '{}')
+			FROM roles r
+			LEFT JOIN roles_permissions rp ON rp.role_id=r.id
+			LEFT JOIN permissions p ON rp.permission_id=p.id
+			WHERE r.id=$1
+			GROUP BY r.id`
+
+	role := &Role{}
+
+	m := pgtype.NewMap()
+	var permissions []string
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := model.DB.QueryRowContext(ctx, SQL, id).Scan(&role.ID, &role.Name, &role.Description, &role.Version, &role.CreatedAt, m.SQLScanner(&permissions))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	role.Permissions = permissions
+	return role, nil
+}
+
+// Insert creates the role and its permission grants in a single transaction
+func (model RoleModel) Insert(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	SQL := `INSERT INTO roles (name, description)
+			VALUES ($1, $2)
+			RETURNING id, created_at, version`
+
+	err = tx.QueryRowContext(ctx, SQL, role.Name, role.Description).Scan(&role.ID, &role.CreatedAt, &role.Version)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), `violates unique constraint "roles_name_key"`):
+			return ErrDuplicateRoleName
+		default:
+			return err
+		}
+	}
+
+	err = setRolePermissions(ctx, tx, role)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Update replaces the role's name, description and permission grants
+func (model RoleModel) Update(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	SQL := `UPDATE roles
+			SET name=$1, description=$2, version=version+1
+			WHERE id=$3 AND version=$4
+			RETURNING version`
+
+	args := []interface{}{role.Name, role.Description, role.ID, role.Version}
+
+	err = tx.QueryRowContext(ctx, SQL, args...).Scan(&role.Version)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), `violates unique constraint "roles_name_key"`):
+			return ErrDuplicateRoleName
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM roles_permissions WHERE role_id=$1`, role.ID)
+	if err != nil {
+		return err
+	}
+
+	err = setRolePermissions(ctx, tx, role)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	model.cache.invalidateAll()
+	return err
+}
+
+func setRolePermissions(ctx context.Context, tx *sql.Tx, role *Role) error {
+	err := insertPermissionPatterns(ctx, tx, role.Permissions)
+	if err != nil {
+		return err
+	}
+
+	SQL := `INSERT INTO roles_permissions (role_id, permission_id)
+			SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+
+	_, err = tx.ExecContext(ctx, SQL, role.ID, []string(role.Permissions))
+	return err
+}
+
+func (model RoleModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	SQL := `DELETE FROM roles WHERE id=$1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := model.DB.ExecContext(ctx, SQL, id)
+	if err != nil {
+		return err
+	}
+
+	model.cache.invalidateAll()
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (model RoleModel) GetAllForUser(userID int64) ([]string, error) {
+	SQL := `SELECT r.name FROM roles r
+			INNER JOIN users_roles ur ON ur.role_id=r.id
+			WHERE ur.user_id=$1
+			ORDER BY r.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+func (model RoleModel) AddForUser(userID int64, roleName ...string) error {
+	SQL := `INSERT INTO users_roles (user_id, role_id)
+			SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+			ON CONFLICT DO NOTHING`
+
+	args := []interface{}{userID, roleName}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := model.DB.ExecContext(ctx, SQL, args...)
+	model.cache.invalidate(userID)
+	return err
+}
+
+func (model RoleModel) RemoveForUser(userID int64, roleName ...string) error {
+	SQL := `DELETE FROM users_roles
+			WHERE user_id = $1 AND role_id IN (SELECT roles.id FROM roles WHERE roles.name = ANY($2))`
+
+	args := []interface{}{userID, roleName}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := model.DB.ExecContext(ctx, SQL, args...)
+	model.cache.invalidate(userID)
+	return err
+}
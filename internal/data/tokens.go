@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/mnabil1718/greenlight/internal/validator"
@@ -14,14 +15,35 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeEmailChange    = "email-change"
+	ScopeDataExport     = "data-export"
+	ScopeMFAPending     = "mfa-pending"
+	ScopeMagicLink      = "magic-link"
+	ScopeRefresh        = "refresh"
 )
 
+// ErrTokenReused is returned when a refresh token that was already
+// rotated is presented again, a sign that it may have been stolen
+var ErrTokenReused = errors.New("token reused")
+
 type Token struct {
-	Plaintext  string    `json:"token,omitempty"`
-	Hash       []byte    `json:"-"`
-	UserID     int64     `json:"-"`
-	ExpiryTime time.Time `json:"expiry_time,omitempty"`
-	Scope      string    `json:"-"`
+	ID         int64      `json:"id"`
+	Plaintext  string     `json:"token,omitempty"`
+	Hash       []byte     `json:"-"`
+	UserID     int64      `json:"-"`
+	ExpiryTime time.Time  `json:"expiry_time,omitempty"`
+	Scope      string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"` // nil until the token is first used
+	UserAgent  string     `json:"user_agent,omitempty"`
+	IP         string     `json:"ip,omitempty"`
+	Label      string     `json:"label,omitempty"`
+	FamilyID   *int64     `json:"-"` // shared by a session's access and refresh tokens
+	UsedAt     *time.Time `json:"-"` // set once a refresh token has been rotated
+	AccessJTI  string     `json:"-"` // signed access token issued with a refresh token
+	// the admin acting as the user, nil for the user's own tokens
+	ImpersonatorID *int64 `json:"impersonator_id,omitempty"`
 }
 
 func generateToken(userID int64, scope string, ttl time.Duration) (*Token, error) {
@@ -31,21 +53,34 @@ func generateToken(userID int64, scope string, ttl time.Duration) (*Token, error
 		ExpiryTime: time.Now().Add(ttl),
 	}
 
-	randomBytes := make([]byte, 16)  // allocate []byte with length of 16
-	_, err := rand.Read(randomBytes) // fill it with random bytes entropy
+	plaintext, hash, err := generateSecret(16)
 	if err != nil {
 		return nil, err
 	}
 
-	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	token.Plaintext = plaintext
+	token.Hash = hash
+
+	return token, nil
+}
+
+// generateSecret returns a random base32 encoded secret of
+// size bytes of entropy, along with its SHA-256 hash
+func generateSecret(size int) (string, []byte, error) {
+	randomBytes := make([]byte, size) // allocate []byte with length of size
+	_, err := rand.Read(randomBytes)  // fill it with random bytes entropy
+	if err != nil {
+		return "", nil, err
+	}
+
+	plaintext := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
 	// array to slice conversion cannot happen in one line
 	// because to initialize a slice buffer, memory allocation
 	// has to exists on the heap not the stack
 	// see: https://stackoverflow.com/questions/28886616/convert-array-to-slice-in-go
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	token.Hash = hash[:]
+	hash := sha256.Sum256([]byte(plaintext))
 
-	return token, nil
+	return plaintext, hash[:], nil
 }
 
 type TokenModel struct {
@@ -57,16 +92,29 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 16 bytes long")
 }
 
-func (model TokenModel) Insert(token *Token) error {
-	SQL := `INSERT INTO tokens (hash, user_id, expiry_time, scope)
-			VALUES ($1, $2, $3, $4)`
-
-	args := []interface{}{token.Hash, token.UserID, token.ExpiryTime, token.Scope}
+func ValidateTokenLabel(v *validator.Validator, label string) {
+	v.Check(len(label) <= 100, "label", "must not be more than 100 bytes long")
+}
 
+func (model TokenModel) Insert(token *Token) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	_, err := model.DB.ExecContext(ctx, SQL, args...)
-	return err
+	return insertToken(ctx, model.DB, token)
+}
+
+// rowQuerier is what *sql.DB and *sql.Tx have in common for inserts
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func insertToken(ctx context.Context, db rowQuerier, token *Token) error {
+	SQL := `INSERT INTO tokens (hash, user_id, expiry_time, scope, user_agent, ip, label, family_id, impersonator_id, access_jti)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			RETURNING id, created_at`
+
+	args := []interface{}{token.Hash, token.UserID, token.ExpiryTime, token.Scope, token.UserAgent, token.IP, token.Label, token.FamilyID, token.ImpersonatorID, token.AccessJTI}
+
+	return db.QueryRowContext(ctx, SQL, args...).Scan(&token.ID, &token.CreatedAt)
 }
 
 func (model TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -79,6 +127,248 @@ func (model TokenModel) New(userID int64, ttl time.Duration, scope string) (*Tok
 	return token, err
 }
 
+// family returns familyID, or a new family id when it is 0
+func (model TokenModel) family(familyID int64) (int64, error) {
+	if familyID != 0 {
+		return familyID, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := model.DB.QueryRowContext(ctx, `SELECT nextval('token_families_seq')`).Scan(&familyID)
+	return familyID, err
+}
+
+// NewSession creates an authentication token and the refresh token
+// that renews it. Both remember where they were issued, so they can be
+// listed as a session later, and belong to the same family. A familyID
+// of 0 starts a new family, a rotation passes the existing one and the
+// family's older authentication tokens are deleted.
+func (model TokenModel) NewSession(userID int64, ttl, refreshTTL time.Duration, userAgent, ip, label string, familyID int64) (*Token, *Token, error) {
+	rotation := familyID != 0
+
+	familyID, err := model.family(familyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	if rotation {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family_id=$1 AND scope=$2`, familyID, ScopeAuthentication)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	tokens := []*Token{}
+	for _, scope := range []string{ScopeAuthentication, ScopeRefresh} {
+		tokenTTL := ttl
+		if scope == ScopeRefresh {
+			tokenTTL = refreshTTL
+		}
+
+		token, err := generateToken(userID, scope, tokenTTL)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		token.UserAgent = userAgent
+		token.IP = ip
+		token.Label = label
+		token.FamilyID = &familyID
+
+		err = insertToken(ctx, tx, token)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tokens[0], tokens[1], nil
+}
+
+// NewImpersonation creates an authentication token for userID that
+// is used by impersonatorID. It has no refresh token, once it
+// expires the impersonator has to start over.
+func (model TokenModel) NewImpersonation(userID, impersonatorID int64, ttl time.Duration, userAgent, ip string) (*Token, error) {
+	token, err := generateToken(userID, ScopeAuthentication, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	token.UserAgent = userAgent
+	token.IP = ip
+	token.Label = "impersonation"
+	token.ImpersonatorID = &impersonatorID
+
+	err = model.Insert(token)
+	return token, err
+}
+
+// GetSession is GetForToken for authentication tokens, it also
+// returns the token so authenticate can tell who is using it
+func (model TokenModel) GetSession(tokenPlaintext string) (*Token, *User, error) {
+	SQL := `SELECT t.id, t.expiry_time, t.scope, t.created_at, t.family_id, t.impersonator_id,
+			u.id, u.name, u.email, u.pending_email, u.password, u.activated, u.deactivated_at, u.version, u.created_at
+			FROM tokens t
+			INNER JOIN users u ON u.id=t.user_id
+			WHERE t.hash=$1 AND t.scope=$2 AND t.expiry_time > NOW()`
+
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	args := []interface{}{hash[:], ScopeAuthentication}
+
+	token := &Token{Plaintext: tokenPlaintext, Hash: hash[:]}
+	user := &User{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(
+		&token.ID, &token.ExpiryTime, &token.Scope, &token.CreatedAt, &token.FamilyID, &token.ImpersonatorID,
+		&user.ID, &user.Name, &user.Email, &user.PendingEmail, &user.Password.hash, &user.Activated, &user.DeactivatedAt, &user.Version, &user.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	token.UserID = user.ID
+	return token, user, nil
+}
+
+// NewRefresh creates only the refresh token of a session, for when
+// the access token is a signed token that isn't stored. Its id is
+// kept with the refresh token, so revoking the session can deny it.
+func (model TokenModel) NewRefresh(userID int64, ttl time.Duration, userAgent, ip, label string, familyID int64, accessJTI string) (*Token, error) {
+	familyID, err := model.family(familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := generateToken(userID, ScopeRefresh, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	token.UserAgent = userAgent
+	token.IP = ip
+	token.Label = label
+	token.FamilyID = &familyID
+	token.AccessJTI = accessJTI
+
+	err = model.Insert(token)
+	return token, err
+}
+
+// UseRefresh marks an unexpired refresh token as used so it can
+// only be rotated once. If the token was already used it returns
+// ErrTokenReused along with the token, so its family can be revoked.
+func (model TokenModel) UseRefresh(tokenPlaintext string) (*Token, error) {
+	SQL := `UPDATE tokens SET used_at = NOW()
+			WHERE hash=$1 AND scope=$2 AND expiry_time > NOW() AND used_at IS NULL
+			RETURNING id, user_id, expiry_time, scope, created_at, user_agent, ip, label, family_id, used_at, access_jti`
+
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	args := []interface{}{hash[:], ScopeRefresh}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	token := &Token{}
+	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&token.ID, &token.UserID, &token.ExpiryTime, &token.Scope, &token.CreatedAt, &token.UserAgent, &token.IP, &token.Label, &token.FamilyID, &token.UsedAt, &token.AccessJTI)
+	if err == nil {
+		return token, nil
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// either the token doesn't exist or it was rotated already,
+	// used tokens are kept until they expire to tell them apart
+	SQL = `SELECT id, user_id, family_id, used_at
+			FROM tokens
+			WHERE hash=$1 AND scope=$2 AND expiry_time > NOW() AND used_at IS NOT NULL`
+
+	err = model.DB.QueryRowContext(ctx, SQL, args...).Scan(&token.ID, &token.UserID, &token.FamilyID, &token.UsedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return token, ErrTokenReused
+}
+
+func (model TokenModel) GetAllForUser(scope string, userID int64) ([]*Token, error) {
+	SQL := `SELECT id, user_id, expiry_time, scope, created_at, last_used_at, user_agent, ip, label, impersonator_id
+			FROM tokens
+			WHERE scope=$1 AND user_id=$2 AND expiry_time > NOW() AND used_at IS NULL
+			ORDER BY created_at DESC, id DESC`
+
+	args := []interface{}{scope, userID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+	for rows.Next() {
+		token := &Token{}
+		err = rows.Scan(&token.ID, &token.UserID, &token.ExpiryTime, &token.Scope, &token.CreatedAt, &token.LastUsedAt, &token.UserAgent, &token.IP, &token.Label, &token.ImpersonatorID)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// Touch records that the token has just been used. It only
+// writes once a minute per token to keep the update cheap
+func (model TokenModel) Touch(hash []byte) error {
+	SQL := `UPDATE tokens SET last_used_at = NOW()
+			WHERE hash=$1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := model.DB.ExecContext(ctx, SQL, hash)
+	return err
+}
+
 func (model TokenModel) DeleteForAllUser(scope string, userID int64) error {
 	SQL := `DELETE FROM tokens
 			WHERE scope=$1 and user_id=$2`
@@ -89,3 +379,185 @@ func (model TokenModel) DeleteForAllUser(scope string, userID int64) error {
 	_, err := model.DB.ExecContext(ctx, SQL, args...)
 	return err
 }
+
+func (model TokenModel) DeleteByHash(scope string, hash []byte) error {
+	SQL := `DELETE FROM tokens
+			WHERE scope=$1 AND hash=$2`
+
+	args := []interface{}{scope, hash}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := model.DB.ExecContext(ctx, SQL, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (model TokenModel) DeleteByID(scope string, id int64, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	SQL := `DELETE FROM tokens
+			WHERE scope=$1 AND id=$2 AND user_id=$3`
+
+	args := []interface{}{scope, id, userID}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := model.DB.ExecContext(ctx, SQL, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteFamily revokes every token of a session, the access
+// token and all of the refresh tokens it has been rotated through.
+// It returns the ids of the signed access tokens issued with them.
+func (model TokenModel) DeleteFamily(familyID int64) ([]string, error) {
+	SQL := `DELETE FROM tokens
+			WHERE family_id=$1
+			RETURNING access_jti`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	jtis, _, err := scanAccessJTIs(rows)
+	return jtis, err
+}
+
+// scanAccessJTIs collects the non-empty access_jti values returned by
+// a DELETE, along with the number of rows deleted. It closes rows.
+func scanAccessJTIs(rows *sql.Rows) ([]string, int, error) {
+	defer rows.Close()
+
+	jtis := []string{}
+	deleted := 0
+	for rows.Next() {
+		var jti string
+		err := rows.Scan(&jti)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		deleted++
+		if jti != "" {
+			jtis = append(jtis, jti)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return jtis, deleted, nil
+}
+
+// DeleteSessionByHash revokes the session an authentication token
+// belongs to, including its refresh tokens
+func (model TokenModel) DeleteSessionByHash(hash []byte) error {
+	SQL := `DELETE FROM tokens
+			WHERE (scope=$1 AND hash=$2)
+			OR family_id = (SELECT family_id FROM tokens WHERE scope=$1 AND hash=$2)`
+
+	args := []interface{}{ScopeAuthentication, hash}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := model.DB.ExecContext(ctx, SQL, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteSessionByID is DeleteSessionByHash for a session listed by id,
+// scoped to its owner. Sessions are listed by their authentication
+// token, or by their refresh token when access tokens are signed, which
+// scope says. It returns the ids of the signed access tokens revoked.
+func (model TokenModel) DeleteSessionByID(scope string, id int64, userID int64) ([]string, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	SQL := `DELETE FROM tokens
+			WHERE user_id=$3 AND ((scope=$1 AND id=$2)
+			OR family_id = (SELECT family_id FROM tokens WHERE scope=$1 AND id=$2 AND user_id=$3))
+			RETURNING access_jti`
+
+	args := []interface{}{scope, id, userID}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	jtis, deleted, err := scanAccessJTIs(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if deleted == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	return jtis, nil
+}
+
+// DeleteSessionsForUser revokes all of the user's authentication and
+// refresh tokens, returning the ids of the signed access tokens issued
+// with them
+func (model TokenModel) DeleteSessionsForUser(userID int64) ([]string, error) {
+	SQL := `DELETE FROM tokens
+			WHERE scope = ANY($1) AND user_id=$2
+			RETURNING access_jti`
+
+	args := []interface{}{[]string{ScopeAuthentication, ScopeRefresh}, userID}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	jtis, _, err := scanAccessJTIs(rows)
+	return jtis, err
+}
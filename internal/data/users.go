@@ -5,11 +5,11 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 
 	"github.com/mnabil1718/greenlight/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -17,13 +17,15 @@ var (
 )
 
 type User struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Activated bool      `json:"activated"`
-	Password  password  `json:"-"`
-	Version   int32     `json:"-"`
-	CreatedAt time.Time `json:"created_at"`
+	ID            int64      `json:"id"`
+	Name          string     `json:"name"`
+	Email         string     `json:"email"`
+	PendingEmail  *string    `json:"pending_email,omitempty"` // awaiting confirmation, nil when there is none
+	Activated     bool       `json:"activated"`
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"` // set when an admin deactivates the account
+	Password      password   `json:"-"`
+	Version       int32      `json:"-"`
+	CreatedAt     time.Time  `json:"created_at"`
 }
 
 var AnonymousUser = &User{}
@@ -37,8 +39,9 @@ type password struct {
 	hash      []byte
 }
 
+// Set hashes with the configured algorithm, see SetPasswordConfig
 func (password *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := hashPassword(plaintextPassword)
 	if err != nil {
 		return err
 	}
@@ -50,16 +53,13 @@ func (password *password) Set(plaintextPassword string) error {
 }
 
 func (password *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(password.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
-	return true, nil
+	return comparePassword(password.hash, plaintextPassword)
+}
+
+// NeedsRehash is checked after a successful login, when the
+// plaintext is at hand to hash again with the current settings
+func (password *password) NeedsRehash() bool {
+	return passwordNeedsRehash(password.hash)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -70,7 +70,14 @@ func ValidateEmail(v *validator.Validator, email string) {
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(len(password) <= maxPasswordLength(), "password", fmt.Sprintf("must not be more than %d bytes long", maxPasswordLength()))
+}
+
+// ValidatePasswordLogin is for passwords being checked rather than
+// set, only the length of new passwords depends on the algorithm
+func ValidatePasswordLogin(v *validator.Validator, password string) {
+	v.Check(password != "", "password", "must be provided")
+	v.Check(len(password) <= maxLoginPasswordLength, "password", fmt.Sprintf("must not be more than %d bytes long", maxLoginPasswordLength))
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -110,8 +117,77 @@ func (model UserModel) Insert(user *User) error {
 	return nil
 }
 
+func (model UserModel) GetAll(name string, email string, activated *bool, filters Filters) ([]*User, Metadata, error) {
+	// a nil activated pointer is sent as NULL and disables that filter
+	SQL := fmt.Sprintf(`
+			SELECT COUNT(*) OVER(), id, name, email, pending_email, activated, deactivated_at, created_at, version
+			FROM users
+			WHERE (name ILIKE '%%' || $1 || '%%' OR $1 = '')
+			AND (email = $2 OR $2 = '')
+			AND (activated = $3 OR $3 IS NULL)
+			ORDER BY %s %s, id ASC
+			LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+
+	args := []interface{}{name, email, activated, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		user := &User{}
+
+		err := rows.Scan(&totalRecords, &user.ID, &user.Name, &user.Email, &user.PendingEmail, &user.Activated, &user.DeactivatedAt, &user.CreatedAt, &user.Version)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
+func (model UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	SQL := `SELECT id, name, email, pending_email, password, activated, deactivated_at, created_at, version 
+			FROM users WHERE id = $1`
+
+	user := &User{}
+	args := []interface{}{id}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&user.ID, &user.Name, &user.Email, &user.PendingEmail, &user.Password.hash, &user.Activated, &user.DeactivatedAt, &user.CreatedAt, &user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
 func (model UserModel) GetByEmail(email string) (*User, error) {
-	SQL := `SELECT id, name, email, password, activated, created_at, version 
+	SQL := `SELECT id, name, email, pending_email, password, activated, deactivated_at, created_at, version 
 			FROM users WHERE email = $1`
 
 	user := &User{}
@@ -119,7 +195,7 @@ func (model UserModel) GetByEmail(email string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&user.ID, &user.Name, &user.Email, &user.Password.hash, &user.Activated, &user.CreatedAt, &user.Version)
+	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&user.ID, &user.Name, &user.Email, &user.PendingEmail, &user.Password.hash, &user.Activated, &user.DeactivatedAt, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -137,11 +213,11 @@ func (model UserModel) Update(user *User) error {
 	// then UNIQUE constraint won't kick in
 
 	SQL := `UPDATE users 
-			SET name=$1, email=$2, password=$3, activated=$4, version=version+1
-			WHERE id=$5 AND version=$6
+			SET name=$1, email=$2, pending_email=$3, password=$4, activated=$5, deactivated_at=$6, version=version+1
+			WHERE id=$7 AND version=$8
 			RETURNING version`
 
-	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated, user.ID, user.Version}
+	args := []interface{}{user.Name, user.Email, user.PendingEmail, user.Password.hash, user.Activated, user.DeactivatedAt, user.ID, user.Version}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -149,7 +225,7 @@ func (model UserModel) Update(user *User) error {
 	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case strings.Contains(err.Error(), `violates unique constraint "users_email_key"`):
 			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
@@ -162,7 +238,7 @@ func (model UserModel) Update(user *User) error {
 }
 
 func (model UserModel) GetForToken(scope string, tokenPlainText string) (*User, error) {
-	SQL := `SELECT u.id, u.name, u.email, u.password, u.activated, u.version, u.created_at FROM users u 
+	SQL := `SELECT u.id, u.name, u.email, u.pending_email, u.password, u.activated, u.deactivated_at, u.version, u.created_at FROM users u 
 			INNER JOIN tokens t ON t.user_id=u.id
 			WHERE t.hash=$1 AND t.scope=$2 AND expiry_time > NOW()`
 
@@ -175,7 +251,7 @@ func (model UserModel) GetForToken(scope string, tokenPlainText string) (*User,
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&user.ID, &user.Name, &user.Email, &user.Password.hash, &user.Activated, &user.Version, &user.CreatedAt)
+	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&user.ID, &user.Name, &user.Email, &user.PendingEmail, &user.Password.hash, &user.Activated, &user.DeactivatedAt, &user.Version, &user.CreatedAt)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -188,12 +264,57 @@ func (model UserModel) GetForToken(scope string, tokenPlainText string) (*User,
 	return user, nil
 }
 
+// Delete removes the user, tokens and permission
+// grants go along with it through ON DELETE CASCADE
+func (model UserModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	SQL := `DELETE FROM users WHERE id=$1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := model.DB.ExecContext(ctx, SQL, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
 type MockUserModel struct{}
 
+func (model MockUserModel) GetAll(name string, email string, activated *bool, filters Filters) ([]*User, Metadata, error) {
+	return nil, Metadata{}, nil
+}
+
 func (model MockUserModel) Insert(user *User) error {
 	return nil
 }
 
+func (model MockUserModel) Get(id int64) (*User, error) {
+	user := &User{
+		ID:        id,
+		Name:      "Elole Kusk",
+		Email:     "elole@gmail.com",
+		Activated: true,
+		Version:   1,
+		CreatedAt: time.Now(),
+	}
+
+	return user, nil
+}
+
 func (model MockUserModel) GetByEmail(email string) (*User, error) {
 	user := &User{
 		ID:        1,
@@ -222,3 +343,7 @@ func (model MockUserModel) GetForToken(scope string, tokenPlainText string) (*Us
 	}
 	return user, nil
 }
+
+func (model MockUserModel) Delete(id int64) error {
+	return nil
+}
@@ -0,0 +1,219 @@
+// Package jwt signs and verifies compact JSON Web Tokens with HS256 or
+// EdDSA (Ed25519). Every token names the key it was signed with in its
+// "kid" header, so old keys can keep verifying while a new one signs.
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+)
+
+var (
+	ErrInvalidToken = errors.New("jwt: invalid token")
+	ErrExpiredToken = errors.New("jwt: token has expired")
+	ErrUnknownKey   = errors.New("jwt: unknown key id")
+)
+
+var encoding = base64.RawURLEncoding
+
+// Claims holds the registered claims used by the API, along with
+// the permissions the user held when the token was issued
+type Claims struct {
+	Subject     string   `json:"sub"`
+	ExpiresAt   int64    `json:"exp"`
+	IssuedAt    int64    `json:"iat"`
+	ID          string   `json:"jti"`
+	Permissions []string `json:"perms"`
+	Activated   bool     `json:"activated"`
+	Family      int64    `json:"fam,omitempty"` // refresh token family issued alongside
+	Org         int64    `json:"org,omitempty"` // organization requests act in by default
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+type Key struct {
+	ID        string
+	Algorithm string
+	secret    []byte
+	private   ed25519.PrivateKey
+	public    ed25519.PublicKey
+}
+
+// ParseKey reads a key written as "kid:alg:base64key". HS256 keys are
+// a secret of at least 32 bytes, EdDSA keys are a 32 byte Ed25519 seed.
+func ParseKey(spec string) (*Key, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, fmt.Errorf("jwt: key %q must be formatted as kid:alg:base64key", spec)
+	}
+
+	material, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("jwt: key %q is not valid base64", parts[0])
+	}
+
+	key := &Key{ID: parts[0], Algorithm: parts[1]}
+
+	switch key.Algorithm {
+	case AlgHS256:
+		if len(material) < 32 {
+			return nil, fmt.Errorf("jwt: HS256 key %q must be at least 32 bytes long", key.ID)
+		}
+		key.secret = material
+	case AlgEdDSA:
+		if len(material) != ed25519.SeedSize {
+			return nil, fmt.Errorf("jwt: EdDSA key %q must be a %d byte seed", key.ID, ed25519.SeedSize)
+		}
+		key.private = ed25519.NewKeyFromSeed(material)
+		key.public = key.private.Public().(ed25519.PublicKey)
+	default:
+		return nil, fmt.Errorf("jwt: key %q has unsupported algorithm %q", key.ID, key.Algorithm)
+	}
+
+	return key, nil
+}
+
+func (key *Key) sign(input []byte) []byte {
+	if key.Algorithm == AlgEdDSA {
+		return ed25519.Sign(key.private, input)
+	}
+
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write(input)
+	return mac.Sum(nil)
+}
+
+func (key *Key) verify(input, signature []byte) bool {
+	if key.Algorithm == AlgEdDSA {
+		return ed25519.Verify(key.public, input, signature)
+	}
+
+	return hmac.Equal(key.sign(input), signature)
+}
+
+// Signer signs with its current key and verifies with any of its keys
+type Signer struct {
+	keys    map[string]*Key
+	current *Key
+}
+
+func NewSigner(keys []*Key, currentID string) (*Signer, error) {
+	signer := &Signer{keys: make(map[string]*Key)}
+
+	for _, key := range keys {
+		if _, exists := signer.keys[key.ID]; exists {
+			return nil, fmt.Errorf("jwt: duplicate key id %q", key.ID)
+		}
+		signer.keys[key.ID] = key
+	}
+
+	current, ok := signer.keys[currentID]
+	if !ok {
+		return nil, fmt.Errorf("jwt: current key id %q is not among the keys", currentID)
+	}
+	signer.current = current
+
+	return signer, nil
+}
+
+// NewID returns a random token id for the jti claim
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func (signer *Signer) Sign(claims Claims) (string, error) {
+	h, err := json.Marshal(header{Algorithm: signer.current.Algorithm, Type: "JWT", KeyID: signer.current.ID})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := encoding.EncodeToString(h) + "." + encoding.EncodeToString(payload)
+	signature := signer.current.sign([]byte(input))
+
+	return input + "." + encoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature with the key named in the header and
+// returns the claims of a token that hasn't expired at now. The
+// algorithm must match the key, the header alone is never trusted.
+func (signer *Signer) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	rawHeader, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var h header
+	err = json.Unmarshal(rawHeader, &h)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, ok := signer.keys[h.KeyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	if h.Algorithm != key.Algorithm {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+
+	return &claims, nil
+}
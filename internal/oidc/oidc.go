@@ -0,0 +1,421 @@
+// Package oidc implements the relying party side of the OpenID Connect
+// authorization code flow with PKCE: building the authorization URL,
+// exchanging the code, and verifying RS256 ID tokens against the
+// provider's JWKS.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidIDToken = errors.New("oidc: invalid id token")
+	ErrUnknownKey     = errors.New("oidc: id token signed with unknown key")
+)
+
+var encoding = base64.RawURLEncoding
+
+// Config holds the client registration. Endpoints left empty
+// are filled in from the issuer's discovery document.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	AuthURL      string
+	TokenURL     string
+	JWKSURL      string
+	Scopes       []string
+	ClockSkew    time.Duration
+	HTTPClient   *http.Client
+}
+
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu        sync.RWMutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// IDToken holds the claims of a verified ID token
+type IDToken struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// audience accepts both forms the aud claim comes in, a string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// New returns a provider, running discovery first when
+// any of the endpoints isn't configured explicitly
+func New(ctx context.Context, config Config) (*Provider, error) {
+	if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, errors.New("oidc: issuer, client id and redirect url are required")
+	}
+
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	provider := &Provider{
+		config: config,
+		client: config.HTTPClient,
+		keys:   make(map[string]*rsa.PublicKey),
+	}
+
+	if provider.client == nil {
+		provider.client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if config.AuthURL == "" || config.TokenURL == "" || config.JWKSURL == "" {
+		err := provider.discover(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return provider, nil
+}
+
+func (provider *Provider) discover(ctx context.Context) error {
+	var document struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		JWKSURL  string `json:"jwks_uri"`
+	}
+
+	wellKnown := strings.TrimSuffix(provider.config.Issuer, "/") + "/.well-known/openid-configuration"
+
+	err := provider.getJSON(ctx, wellKnown, &document)
+	if err != nil {
+		return err
+	}
+
+	if document.Issuer != provider.config.Issuer {
+		return fmt.Errorf("oidc: discovery issuer %q does not match %q", document.Issuer, provider.config.Issuer)
+	}
+
+	if provider.config.AuthURL == "" {
+		provider.config.AuthURL = document.AuthURL
+	}
+	if provider.config.TokenURL == "" {
+		provider.config.TokenURL = document.TokenURL
+	}
+	if provider.config.JWKSURL == "" {
+		provider.config.JWKSURL = document.JWKSURL
+	}
+
+	return nil
+}
+
+func (provider *Provider) getJSON(ctx context.Context, url string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := provider.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s returned %s", url, res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(dst)
+}
+
+// NewVerifier returns a random PKCE code verifier and its S256 challenge
+func NewVerifier() (verifier string, challenge string, err error) {
+	verifier, err = randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, encoding.EncodeToString(sum[:]), nil
+}
+
+// NewState returns a random value for the state or nonce parameters
+func NewState() (string, error) {
+	return randomString(32)
+}
+
+func randomString(size int) (string, error) {
+	b := make([]byte, size)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(b), nil
+}
+
+func (provider *Provider) AuthCodeURL(state, nonce, challenge string) string {
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.config.ClientID)
+	query.Set("redirect_uri", provider.config.RedirectURL)
+	query.Set("scope", strings.Join(provider.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", challenge)
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(provider.config.AuthURL, "?") {
+		separator = "&"
+	}
+
+	return provider.config.AuthURL + separator + query.Encode()
+}
+
+// Exchange trades an authorization code for the raw ID token
+func (provider *Provider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", provider.config.RedirectURL)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(provider.config.ClientID), url.QueryEscape(provider.config.ClientSecret))
+
+	res, err := provider.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("oidc: decoding token response: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("oidc: token endpoint returned %s: %s %s", res.Status, body.Error, body.ErrorDescription)
+	}
+
+	if body.IDToken == "" {
+		return "", errors.New("oidc: token response has no id_token")
+	}
+
+	return body.IDToken, nil
+}
+
+// Verify checks the signature, issuer, audience, expiry and nonce of
+// a raw ID token. Keys are fetched from the JWKS when a token names
+// one that isn't known yet, which also picks up key rotations.
+func (provider *Provider) Verify(ctx context.Context, rawIDToken, nonce string) (*IDToken, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+
+	rawHeader, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+
+	err = json.Unmarshal(rawHeader, &header)
+	if err != nil || header.Algorithm != "RS256" {
+		return nil, ErrInvalidIDToken
+	}
+
+	key, err := provider.key(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	payload, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	var token IDToken
+	err = json.Unmarshal(payload, &token)
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	now := time.Now()
+	skew := int64(provider.config.ClockSkew.Seconds())
+
+	switch {
+	case token.Issuer != provider.config.Issuer:
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidIDToken, token.Issuer)
+	case !contains(token.Audience, provider.config.ClientID):
+		return nil, fmt.Errorf("%w: not issued for this client", ErrInvalidIDToken)
+	case now.Unix() > token.ExpiresAt+skew:
+		return nil, fmt.Errorf("%w: expired", ErrInvalidIDToken)
+	case token.IssuedAt > now.Unix()+skew:
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidIDToken)
+	case token.Nonce != nonce:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	case token.Subject == "":
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+
+	return &token, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (provider *Provider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	provider.mu.RLock()
+	key, ok := provider.keys[kid]
+	provider.mu.RUnlock()
+
+	if ok {
+		return key, nil
+	}
+
+	// tokens naming made up key ids shouldn't make
+	// us hammer the provider's JWKS endpoint
+	provider.mu.RLock()
+	recent := time.Since(provider.fetchedAt) < time.Minute
+	provider.mu.RUnlock()
+
+	if recent {
+		return nil, ErrUnknownKey
+	}
+
+	err := provider.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	provider.mu.RLock()
+	key, ok = provider.keys[kid]
+	provider.mu.RUnlock()
+
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return key, nil
+}
+
+func (provider *Provider) fetchKeys(ctx context.Context) error {
+	var set struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+		} `json:"keys"`
+	}
+
+	err := provider.getJSON(ctx, provider.config.JWKSURL, &set)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.KeyType != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+
+		n, err := encoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+
+		e, err := encoding.DecodeString(jwk.E)
+		if err != nil || len(e) > 4 {
+			continue
+		}
+
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+
+		keys[jwk.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}
+	}
+
+	provider.mu.Lock()
+	provider.keys = keys
+	provider.fetchedAt = time.Now()
+	provider.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS user_exports (
+    token_hash bytea PRIMARY KEY REFERENCES tokens (hash) ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    archive bytea NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
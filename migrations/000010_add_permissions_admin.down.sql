@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'permissions:admin';
+DROP INDEX IF EXISTS permissions_code_index;
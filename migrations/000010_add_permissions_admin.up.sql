@@ -0,0 +1,6 @@
+CREATE UNIQUE INDEX IF NOT EXISTS permissions_code_index ON permissions (code);
+
+INSERT INTO permissions (code)
+VALUES
+    ('permissions:admin')
+ON CONFLICT (code) DO NOTHING;
@@ -0,0 +1,6 @@
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code IN ('movies:read', 'movies:write', 'admin:users', 'permissions:admin')
+ON CONFLICT DO NOTHING;
+
+DELETE FROM permissions WHERE code = '*';
@@ -0,0 +1,12 @@
+INSERT INTO permissions (code)
+VALUES
+    ('*')
+ON CONFLICT (code) DO NOTHING;
+
+-- the admin role holds every permission, including future ones
+DELETE FROM roles_permissions
+WHERE role_id = (SELECT id FROM roles WHERE name = 'admin');
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code = '*';
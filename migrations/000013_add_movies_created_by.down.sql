@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'movies:admin';
+DROP INDEX IF EXISTS movies_created_by_index;
+ALTER TABLE movies DROP COLUMN IF EXISTS created_by;
@@ -0,0 +1,8 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS movies_created_by_index ON movies (created_by);
+
+INSERT INTO permissions (code)
+VALUES
+    ('movies:admin')
+ON CONFLICT (code) DO NOTHING;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS login_attempts (
+    scope text NOT NULL,
+    identifier text NOT NULL,
+    failures integer NOT NULL DEFAULT 0,
+    lockouts integer NOT NULL DEFAULT 0,
+    locked_until timestamp(0) with time zone,
+    last_failure_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (scope, identifier)
+);
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS token_denylist (
+    jti text PRIMARY KEY,
+    expiry_time timestamp(0) with time zone NOT NULL
+);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS user_identities (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    issuer text NOT NULL,
+    subject text NOT NULL,
+    email citext NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    UNIQUE (issuer, subject)
+);
+
+CREATE TABLE IF NOT EXISTS oidc_states (
+    hash bytea PRIMARY KEY,
+    verifier text NOT NULL,
+    nonce text NOT NULL,
+    expiry_time timestamp(0) with time zone NOT NULL
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS invitations (
+    id bigserial PRIMARY KEY,
+    hash bytea UNIQUE NOT NULL,
+    email citext NOT NULL,
+    roles text[] NOT NULL DEFAULT '{}',
+    permissions text[] NOT NULL DEFAULT '{}',
+    invited_by bigint REFERENCES users ON DELETE SET NULL,
+    expiry_time timestamp(0) with time zone NOT NULL,
+    accepted_at timestamp(0) with time zone,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,5 @@
+DELETE FROM permissions WHERE code = 'admin:impersonate';
+
+DROP TABLE IF EXISTS audit_log;
+
+ALTER TABLE tokens DROP COLUMN IF EXISTS impersonator_id;
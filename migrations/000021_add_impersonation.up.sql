@@ -0,0 +1,20 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS impersonator_id bigint REFERENCES users ON DELETE CASCADE;
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id bigserial PRIMARY KEY,
+    actor_id bigint REFERENCES users ON DELETE SET NULL,
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    method text NOT NULL,
+    path text NOT NULL,
+    status integer NOT NULL,
+    ip text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_actor_id_index ON audit_log (actor_id);
+CREATE INDEX IF NOT EXISTS audit_log_user_id_index ON audit_log (user_id);
+
+INSERT INTO permissions (code)
+VALUES
+    ('admin:impersonate')
+ON CONFLICT (code) DO NOTHING;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS movies_organization_id_index;
+ALTER TABLE movies DROP COLUMN IF EXISTS organization_id;
+
+DROP TABLE IF EXISTS organization_members;
+DROP TABLE IF EXISTS organizations;
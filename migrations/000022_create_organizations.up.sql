@@ -0,0 +1,42 @@
+CREATE TABLE IF NOT EXISTS organizations (
+    id bigserial PRIMARY KEY,
+    name text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS organization_members (
+    organization_id bigint NOT NULL REFERENCES organizations ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role text NOT NULL CHECK (role IN ('owner', 'admin', 'member', 'viewer')),
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (organization_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS organization_members_user_id_index ON organization_members (user_id);
+
+-- existing movies and users move into a default organization,
+-- so the catalog everyone shared so far stays visible to them
+INSERT INTO organizations (id, name)
+VALUES
+    (1, 'Default')
+ON CONFLICT (id) DO NOTHING;
+
+SELECT setval('organizations_id_seq', GREATEST((SELECT MAX(id) FROM organizations), 1));
+
+-- holders of the admin role own it, so its members can be managed
+INSERT INTO organization_members (organization_id, user_id, role)
+SELECT 1, users.id,
+    CASE WHEN EXISTS (
+        SELECT 1 FROM users_roles
+        INNER JOIN roles ON users_roles.role_id = roles.id
+        WHERE users_roles.user_id = users.id AND roles.name = 'admin'
+    ) THEN 'owner' ELSE 'member' END
+FROM users
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS organization_id bigint REFERENCES organizations ON DELETE CASCADE;
+UPDATE movies SET organization_id = 1 WHERE organization_id IS NULL;
+ALTER TABLE movies ALTER COLUMN organization_id SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS movies_organization_id_index ON movies (organization_id);
@@ -0,0 +1,7 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deactivated_at timestamp(0) with time zone;
+
+-- activation deletes the activation tokens, so an inactive user without
+-- any was activated before and has been deactivated by an admin since
+UPDATE users SET deactivated_at = NOW()
+WHERE activated = false
+AND NOT EXISTS (SELECT 1 FROM tokens WHERE tokens.user_id = users.id AND tokens.scope = 'activation');
@@ -0,0 +1,3 @@
+-- the id of the signed access token issued along with a refresh
+-- token, so revoking the session can revoke that token too
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS access_jti text NOT NULL DEFAULT '';